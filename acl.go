@@ -0,0 +1,221 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Roles that can be used in ACL rules instead of peer identifications.
+*/
+const (
+	RoleAll      = "*"        // every peer
+	RoleAdmin    = "admin"    // admin peers
+	RoleWriter   = "writer"   // peers that are not read-only
+	RoleReadOnly = "readonly" // read-only peers
+)
+
+/*
+ACLRule restricts which peers receive and may change the objects below Path. The
+lists contain peer identifications or roles. The rule with the longest matching
+path applies; paths without a rule are open to all peers. NOTE: the Tinzenite
+directory itself can not be restricted.
+*/
+type ACLRule struct {
+	Path    string   // sub path the rule applies to
+	Readers []string // peers that receive the objects
+	Writers []string // peers that may change the objects
+}
+
+/*
+acl caches the rules read from the org directory.
+*/
+type acl struct {
+	mutex sync.Mutex
+	rules []ACLRule
+}
+
+/*
+SetACL replaces all ACL rules. The rules are distributed to all peers.
+*/
+func (t *Tinzenite) SetACL(rules []ACLRule) error {
+	err := t.requireAdmin()
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		cleaned := cleanPaths([]string{rules[i].Path})
+		if len(cleaned) == 0 {
+			rules[i].Path = ""
+		} else {
+			rules[i].Path = cleaned[0]
+		}
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := t.aclPath()
+	err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	// a held change is loaded once approved
+	if !t.needsApproval() {
+		t.acl.mutex.Lock()
+		t.acl.rules = rules
+		t.acl.mutex.Unlock()
+	}
+	return t.model.PartialUpdate(path)
+}
+
+/*
+ACL returns the current ACL rules.
+*/
+func (t *Tinzenite) ACL() []ACLRule {
+	t.acl.mutex.Lock()
+	defer t.acl.mutex.Unlock()
+	return append([]ACLRule(nil), t.acl.rules...)
+}
+
+/*
+loadACL rereads the rules from disk.
+*/
+func (t *Tinzenite) loadACL() error {
+	var rules []ACLRule
+	data, err := ioutil.ReadFile(t.aclPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &rules)
+		if err != nil {
+			return err
+		}
+	}
+	t.acl.mutex.Lock()
+	t.acl.rules = rules
+	t.acl.mutex.Unlock()
+	return nil
+}
+
+/*
+canRead returns true if the peer at address may receive the object at sub path.
+*/
+func (t *Tinzenite) canRead(address, subPath string) bool {
+	rule, exists := t.ruleFor(subPath)
+	if !exists {
+		return true
+	}
+	return t.matchesACL(address, rule.Readers)
+}
+
+/*
+canWrite returns true if the peer at address may change the object at sub path.
+*/
+func (t *Tinzenite) canWrite(address, subPath string) bool {
+	rule, exists := t.ruleFor(subPath)
+	if !exists {
+		return true
+	}
+	return t.matchesACL(address, rule.Writers)
+}
+
+/*
+ruleFor returns the rule with the longest path containing sub path.
+*/
+func (t *Tinzenite) ruleFor(subPath string) (ACLRule, bool) {
+	if isWithin(subPath, shared.TINZENITEDIR) {
+		return ACLRule{}, false
+	}
+	t.acl.mutex.Lock()
+	defer t.acl.mutex.Unlock()
+	var found ACLRule
+	var exists bool
+	for _, rule := range t.acl.rules {
+		if rule.Path != "" && !isWithin(subPath, rule.Path) {
+			continue
+		}
+		if !exists || len(rule.Path) > len(found.Path) {
+			found = rule
+			exists = true
+		}
+	}
+	return found, exists
+}
+
+/*
+matchesACL returns true if the peer at address is in the list, either by its
+identification or by one of its roles.
+*/
+func (t *Tinzenite) matchesACL(address string, list []string) bool {
+	peer, exists := t.peers[address]
+	if !exists {
+		return false
+	}
+	for _, entry := range list {
+		switch entry {
+		case RoleAll:
+			return true
+		case RoleAdmin:
+			if t.IsAdmin(address) {
+				return true
+			}
+		case RoleWriter:
+			if !t.IsReadOnly(address) {
+				return true
+			}
+		case RoleReadOnly:
+			if t.IsReadOnly(address) {
+				return true
+			}
+		default:
+			if entry == peer.Identification {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+withheld is called for updates not sent to the peer at address because of the
+ACL. As the peer never learns of removals it is marked as done with them, so
+that they can complete.
+*/
+func (t *Tinzenite) withheld(address string, msg shared.UpdateMessage) {
+	if msg.Operation != shared.OpRemove {
+		return
+	}
+	err := t.model.UpdateRemovalDir(msg.Object.Identification, t.peers[address].Identification)
+	if err != nil {
+		log.Println("Tin: failed to mark withheld removal as done:", err)
+	}
+}
+
+/*
+dropUnreadable returns a copy of obj without the objects the peer at address
+may not receive, except for directories leading to objects it may.
+*/
+func (t *Tinzenite) dropUnreadable(address string, obj *shared.ObjectInfo) *shared.ObjectInfo {
+	copied := *obj
+	copied.Objects = nil
+	for _, child := range obj.Objects {
+		filtered := t.dropUnreadable(address, child)
+		// keep unreadable directories only as parents of readable objects
+		if !t.canRead(address, child.Path) && len(filtered.Objects) == 0 {
+			continue
+		}
+		copied.Objects = append(copied.Objects, filtered)
+	}
+	return &copied
+}
+
+func (t *Tinzenite) aclPath() string {
+	return t.Path + "/" + shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + ACLFILE
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_ACL(t *testing.T) {
+	tin := &Tinzenite{
+		selfpeer: &shared.Peer{Identification: "ownerID"},
+		peers: map[string]*shared.Peer{
+			"owneraddress":      {Identification: "ownerID", Trusted: true},
+			"contractoraddress": {Identification: "contractorID", Trusted: true},
+			"adminaddress":      {Identification: "adminID", Trusted: true}},
+		roles: createRoles(),
+		acl: &acl{rules: []ACLRule{
+			{Path: "hr", Readers: []string{"ownerID", RoleAdmin}, Writers: []string{"ownerID"}},
+			{Path: "hr/public", Readers: []string{RoleAll}, Writers: []string{"ownerID"}}}}}
+	tin.roles.admin["adminID"] = true
+	if tin.canRead("contractoraddress", "hr/salaries.txt") {
+		t.Error("Expected contractor to not read hr")
+	}
+	if !tin.canRead("adminaddress", "hr/salaries.txt") || !tin.canRead("owneraddress", "hr") {
+		t.Error("Expected admin and owner to read hr")
+	}
+	if tin.canWrite("adminaddress", "hr/salaries.txt") {
+		t.Error("Expected admin to not write hr")
+	}
+	// the longest rule wins
+	if !tin.canRead("contractoraddress", "hr/public/holidays.txt") {
+		t.Error("Expected contractor to read hr/public")
+	}
+	// paths without rules and the Tinzenite directory are open
+	if !tin.canWrite("contractoraddress", "hrextra/file.txt") || !tin.canRead("contractoraddress", shared.TINZENITEDIR+"/org/acl.json") {
+		t.Error("Expected unrestricted paths to be open")
+	}
+	// model dumps drop what may not be read
+	root := &shared.ObjectInfo{Directory: true, Objects: []*shared.ObjectInfo{
+		{Path: "hr", Directory: true, Objects: []*shared.ObjectInfo{{Path: "hr/salaries.txt"}}},
+		{Path: "readme.txt"}}}
+	dropped := tin.dropUnreadable("contractoraddress", root)
+	if len(dropped.Objects) != 1 || dropped.Objects[0].Path != "readme.txt" {
+		t.Error("Expected hr to be dropped, got", dropped.Objects)
+	}
+	// unless it leads to something readable
+	root.Objects[0].Objects = append(root.Objects[0].Objects, &shared.ObjectInfo{Path: "hr/public", Directory: true})
+	dropped = tin.dropUnreadable("contractoraddress", root)
+	if len(dropped.Objects) != 2 || len(dropped.Objects[0].Objects) != 1 || dropped.Objects[0].Objects[0].Path != "hr/public" {
+		t.Error("Expected only hr/public to be kept within hr, got", dropped.Objects)
+	}
+}
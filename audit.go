@@ -0,0 +1,219 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+AuditEntry is a single applied change in the audit log.
+*/
+type AuditEntry struct {
+	Time           time.Time        // time the change was applied
+	Operation      shared.Operation // applied operation
+	Path           string           // sub path of the object
+	Identification string           // identification of the object
+	Version        shared.Version   // version of the object after the change
+	Origin         string           // identification of the peer the change came from
+	Receiver       string           // identification of the peer that applied the change
+	Previous       string           // hash of the previous entry
+	Hash           string           // hash of this entry, including Previous
+}
+
+/*
+AuditFilter selects entries of the audit log. Empty fields match everything.
+*/
+type AuditFilter struct {
+	Path       string             // only entries for paths beginning with this
+	Origin     string             // only entries that came from this peer identification
+	Operations []shared.Operation // only entries of these operations
+	Since      time.Time          // only entries at or after this time
+	Until      time.Time          // only entries before this time
+}
+
+/*
+audit is the append only audit log. Every entry contains the hash of the one
+before it so that any change to the log can be detected.
+*/
+type audit struct {
+	mutex sync.Mutex
+	path  string
+	last  string // hash of the last written entry
+}
+
+func createAudit(path string) *audit {
+	a := &audit{path: path}
+	// continue the chain of an existing log
+	entries, err := a.read()
+	if err != nil {
+		log.Println("Audit: failed to read existing log:", err)
+	}
+	if len(entries) > 0 {
+		a.last = entries[len(entries)-1].Hash
+	}
+	return a
+}
+
+/*
+AuditLog returns all entries of the audit log matching the filter, oldest first.
+*/
+func (t *Tinzenite) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	entries, err := t.audit.read()
+	if err != nil {
+		return nil, err
+	}
+	var matched []AuditEntry
+	for _, entry := range entries {
+		if filter.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+/*
+VerifyAuditLog checks the hash chain of the complete audit log. Returns
+errAuditTampered if any entry was changed, removed or inserted.
+*/
+func (t *Tinzenite) VerifyAuditLog() error {
+	entries, err := t.audit.read()
+	if err != nil {
+		return err
+	}
+	var previous string
+	for _, entry := range entries {
+		if entry.Previous != previous || entry.hash() != entry.Hash {
+			return errAuditTampered
+		}
+		previous = entry.Hash
+	}
+	return nil
+}
+
+/*
+auditLocal records a change made on this peer.
+*/
+func (t *Tinzenite) auditLocal(msg shared.UpdateMessage) {
+	t.auditWrite(msg, t.selfpeer.Identification)
+}
+
+/*
+auditRemote records a change received from the peer at address.
+*/
+func (t *Tinzenite) auditRemote(address string, msg shared.UpdateMessage) {
+	origin := address
+	if peer, exists := t.peers[address]; exists {
+		origin = peer.Identification
+	}
+	t.auditWrite(msg, origin)
+}
+
+func (t *Tinzenite) auditWrite(msg shared.UpdateMessage, origin string) {
+	entry := AuditEntry{
+		Time:           time.Now(),
+		Operation:      msg.Operation,
+		Path:           msg.Object.Path,
+		Identification: msg.Object.Identification,
+		Version:        msg.Object.Version,
+		Origin:         origin,
+		Receiver:       t.selfpeer.Identification}
+	err := t.audit.append(entry)
+	if err != nil {
+		log.Println("Audit: failed to write entry:", err)
+	}
+}
+
+/*
+append writes the entry to the end of the log, chaining it to the last one.
+*/
+func (a *audit) append(entry AuditEntry) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entry.Previous = a.last
+	entry.Hash = entry.hash()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.last = entry.Hash
+	return file.Close()
+}
+
+/*
+read returns all entries of the log.
+*/
+func (a *audit) read() ([]AuditEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	file, err := os.Open(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, errAuditTampered
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+/*
+hash computes the hash of the entry over all fields except Hash itself.
+*/
+func (e AuditEntry) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	if f.Path != "" && !strings.HasPrefix(entry.Path, f.Path) {
+		return false
+	}
+	if f.Origin != "" && entry.Origin != f.Origin {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+	if len(f.Operations) == 0 {
+		return true
+	}
+	for _, op := range f.Operations {
+		if entry.Operation == op {
+			return true
+		}
+	}
+	return false
+}
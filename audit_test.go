@@ -0,0 +1,51 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_AuditChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	tin := &Tinzenite{
+		selfpeer: &shared.Peer{Identification: "self"},
+		peers:    map[string]*shared.Peer{"address": {Identification: "other"}},
+		audit:    createAudit(dir + "/" + AUDITLOG)}
+	create := shared.UpdateMessage{Operation: shared.OpCreate, Object: shared.ObjectInfo{Path: "a/file"}}
+	remove := shared.UpdateMessage{Operation: shared.OpRemove, Object: shared.ObjectInfo{Path: "b/file"}}
+	tin.auditLocal(create)
+	tin.auditRemote("address", remove)
+	// reopening must continue the chain
+	tin.audit = createAudit(dir + "/" + AUDITLOG)
+	tin.auditLocal(remove)
+	if err := tin.VerifyAuditLog(); err != nil {
+		t.Fatal("Expected valid chain:", err)
+	}
+	entries, err := tin.AuditLog(AuditFilter{Origin: "other"})
+	if err != nil || len(entries) != 1 || entries[0].Path != "b/file" || entries[0].Receiver != "self" {
+		t.Error("Expected remote entry, got", entries, err)
+	}
+	entries, _ = tin.AuditLog(AuditFilter{Operations: []shared.Operation{shared.OpRemove}})
+	if len(entries) != 2 {
+		t.Error("Expected 2 removals, got", len(entries))
+	}
+	entries, _ = tin.AuditLog(AuditFilter{Path: "a/"})
+	if len(entries) != 1 {
+		t.Error("Expected 1 entry for path, got", len(entries))
+	}
+	// tamper with the origin of the first entry
+	data, _ := ioutil.ReadFile(dir + "/" + AUDITLOG)
+	tampered := strings.Replace(string(data), `"Origin":"self"`, `"Origin":"evil"`, 1)
+	_ = ioutil.WriteFile(dir+"/"+AUDITLOG, []byte(tampered), 0644)
+	if err := tin.VerifyAuditLog(); err != errAuditTampered {
+		t.Error("Expected tampering to be detected, got", err)
+	}
+}
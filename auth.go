@@ -48,8 +48,16 @@ func loadAuthenticationFrom(path string, password string) (*Authentication, erro
 	if err != nil {
 		return nil, err
 	}
+	return readAuthentication(data, password)
+}
+
+/*
+readAuthentication parses the data of an auth.json file and unlocks it with the
+password.
+*/
+func readAuthentication(data []byte, password string) (*Authentication, error) {
 	auth := &Authentication{}
-	err = json.Unmarshal(data, auth)
+	err := json.Unmarshal(data, auth)
 	if err != nil {
 		return nil, err
 	}
@@ -1,8 +1,9 @@
 package core
 
 /*
-PeerValidation will be called if a peer tries to connect to this peer. The return
-value will state whether the user accepts the connection.
+PeerValidation will be called if a peer tries to connect to this peer. The user
+accepts or refuses the connection by calling AllowPeer or DenyPeer. The request
+is stored until then, so it can also be answered later via PendingPeers.
 */
 type PeerValidation func(address string, requestsTrust bool)
 
@@ -12,3 +13,47 @@ RegisterPeerValidation registers a callback.
 func (t *Tinzenite) RegisterPeerValidation(f PeerValidation) {
 	t.peerValidation = f
 }
+
+/*
+MassChangeValidation will be called if the guard detects a suspicious amount of
+removals or rewrites within a short time, either of local changes (incoming is
+false) or of changes received from other peers. Synchronization in that
+direction is paused until ConfirmMassChange or RejectMassChange is called.
+*/
+type MassChangeValidation func(incoming bool, removed, rewritten int)
+
+/*
+RegisterMassChangeValidation registers a callback. NOTE: the guard is only active
+if a callback has been registered.
+*/
+func (t *Tinzenite) RegisterMassChangeValidation(f MassChangeValidation) {
+	t.massChangeValidation = f
+}
+
+/*
+OrgChangeValidation will be called on admins if a change of the org directory
+requires approval by a quorum of admins. The change is approved by calling
+ApproveOrgChange; all waiting changes can be listed via OrgProposals.
+*/
+type OrgChangeValidation func(proposal OrgProposal)
+
+/*
+RegisterOrgChangeValidation registers a callback.
+*/
+func (t *Tinzenite) RegisterOrgChangeValidation(f OrgChangeValidation) {
+	t.orgChangeValidation = f
+}
+
+/*
+ReplicaWarning will be called if objects fall below the replica target set via
+SetReplicaPolicy, for example because an encrypted peer was removed or reported
+them missing. All such objects can be listed via UnderReplicated.
+*/
+type ReplicaWarning func(objects []ReplicaStatus)
+
+/*
+RegisterReplicaWarning registers a callback.
+*/
+func (t *Tinzenite) RegisterReplicaWarning(f ReplicaWarning) {
+	t.replicaWarning = f
+}
@@ -0,0 +1,183 @@
+package core
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+protocolVersion is the version of the messages exchanged between core peers. It
+must be increased on incompatible changes.
+*/
+const protocolVersion = 1
+
+/*
+coreVersion is the version of this implementation, sent for information only.
+*/
+const coreVersion = "0.1.0"
+
+/*
+Features a peer can support. Features are only used with a peer once its hello
+has announced them.
+*/
+const (
+	FeatureGovernance  = "governance"  // approval of org changes
+	FeaturePing        = "ping"        // latency measurement
+	FeatureCompression = "compression" // compressed transfers
+	FeatureDelta       = "delta"       // delta transfers of modified files
+	FeatureChunked     = "chunked"     // chunked encryption of large files
+	FeatureListing     = "listing"     // encrypted peers listing the objects they hold
+	FeatureLease       = "lease"       // encrypted peers breaking expired leases
+)
+
+/*
+supportedFeatures are the features this implementation supports.
+*/
+var supportedFeatures = []string{FeatureGovernance, FeaturePing, FeatureListing}
+
+/*
+Limits are the limits a peer announces to others.
+*/
+type Limits struct {
+	MaxTransfers int // concurrent file transfers the peer serves to one peer
+}
+
+/*
+Capabilities describe what a peer understands.
+*/
+type Capabilities struct {
+	Protocol int       // protocol version
+	Version  string    // core version, for information only
+	Features []string  // supported features
+	Limits   Limits    // announced limits
+	Received time.Time // time the hello was received, empty for our own
+}
+
+/*
+hello is the message exchanged on every connect. Reply is set on the answer to a
+hello so that it is not answered again.
+*/
+type hello struct {
+	Capabilities Capabilities
+	Reply        bool
+}
+
+/*
+capabilities stores the negotiated capabilities of every connected peer.
+*/
+type capabilities struct {
+	mutex sync.Mutex
+	peers map[string]Capabilities // by address
+}
+
+func createCapabilities() *capabilities {
+	return &capabilities{peers: make(map[string]Capabilities)}
+}
+
+/*
+PeerCapabilities returns the capabilities negotiated with the peer at address.
+Returns false if the peer has not sent a hello, for example because it runs an
+older version.
+*/
+func (t *Tinzenite) PeerCapabilities(address string) (Capabilities, bool) {
+	t.capabilities.mutex.Lock()
+	defer t.capabilities.mutex.Unlock()
+	caps, exists := t.capabilities.peers[address]
+	return caps, exists
+}
+
+/*
+supports returns true if the feature has been negotiated with the peer at
+address.
+*/
+func (t *Tinzenite) supports(address, feature string) bool {
+	caps, exists := t.PeerCapabilities(address)
+	if !exists {
+		return false
+	}
+	for _, supported := range caps.Features {
+		if supported == feature {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+sendHello sends our capabilities to the peer at address.
+*/
+func (t *Tinzenite) sendHello(address string, reply bool) {
+	message, err := createCoreMessage(coreHello, hello{Capabilities: localCapabilities(), Reply: reply})
+	if err != nil {
+		log.Println("Tinzenite: failed to build hello:", err)
+		return
+	}
+	err = t.channel.Send(address, message)
+	if err != nil {
+		log.Println("Tinzenite: failed to send hello:", err)
+	}
+}
+
+/*
+onHello negotiates the capabilities with the peer at address and answers if the
+hello was not an answer itself.
+*/
+func (t *Tinzenite) onHello(address string, msg hello) {
+	remote := msg.Capabilities
+	if remote.Protocol > protocolVersion {
+		log.Println("Tinzenite: peer", address[:8], "runs newer protocol", remote.Protocol, ", using", protocolVersion)
+	}
+	negotiated := negotiate(localCapabilities(), remote)
+	negotiated.Received = time.Now()
+	t.capabilities.mutex.Lock()
+	t.capabilities.peers[address] = negotiated
+	t.capabilities.mutex.Unlock()
+	if !msg.Reply {
+		t.sendHello(address, true)
+	}
+}
+
+/*
+forgetCapabilities drops the capabilities of the peer, as it may come back with
+another version.
+*/
+func (t *Tinzenite) forgetCapabilities(address string) {
+	t.capabilities.mutex.Lock()
+	defer t.capabilities.mutex.Unlock()
+	delete(t.capabilities.peers, address)
+}
+
+func localCapabilities() Capabilities {
+	return Capabilities{
+		Protocol: protocolVersion,
+		Version:  coreVersion,
+		Features: supportedFeatures,
+		Limits:   Limits{MaxTransfers: 1}}
+}
+
+/*
+negotiate returns what both sides support: the lower protocol version, the
+common features and the stricter limits. The version is kept from the remote.
+*/
+func negotiate(local, remote Capabilities) Capabilities {
+	result := Capabilities{
+		Protocol: local.Protocol,
+		Version:  remote.Version,
+		Limits:   local.Limits}
+	if remote.Protocol < result.Protocol {
+		result.Protocol = remote.Protocol
+	}
+	for _, feature := range local.Features {
+		for _, other := range remote.Features {
+			if feature == other {
+				result.Features = append(result.Features, feature)
+				break
+			}
+		}
+	}
+	if remote.Limits.MaxTransfers > 0 && remote.Limits.MaxTransfers < result.Limits.MaxTransfers {
+		result.Limits.MaxTransfers = remote.Limits.MaxTransfers
+	}
+	return result
+}
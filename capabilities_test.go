@@ -0,0 +1,31 @@
+package core
+
+import "testing"
+
+func Test_Negotiate(t *testing.T) {
+	local := Capabilities{
+		Protocol: 2,
+		Version:  "local",
+		Features: []string{FeatureGovernance, FeatureDelta},
+		Limits:   Limits{MaxTransfers: 4}}
+	remote := Capabilities{
+		Protocol: 1,
+		Version:  "remote",
+		Features: []string{FeatureDelta, FeatureCompression},
+		Limits:   Limits{MaxTransfers: 2}}
+	result := negotiate(local, remote)
+	if result.Protocol != 1 || result.Version != "remote" {
+		t.Error("Expected lower protocol and remote version, got", result.Protocol, result.Version)
+	}
+	if len(result.Features) != 1 || result.Features[0] != FeatureDelta {
+		t.Error("Expected only common features, got", result.Features)
+	}
+	if result.Limits.MaxTransfers != 2 {
+		t.Error("Expected stricter limit, got", result.Limits.MaxTransfers)
+	}
+	// unset limits of older peers are ignored
+	remote.Limits = Limits{}
+	if negotiate(local, remote).Limits.MaxTransfers != 4 {
+		t.Error("Expected local limit to be kept")
+	}
+}
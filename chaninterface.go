@@ -5,7 +5,9 @@ import (
 	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tinzenite/channel"
@@ -17,14 +19,14 @@ chaninterface implements the channel.Callbacks interface so that Tinzenite doesn
 export them unnecessarily.
 */
 type chaninterface struct {
-	tin          *Tinzenite              // reference back to Tinzenite
-	inTransfers  map[string]transfer     // map of in transfers, referenced by the object id
-	outTransfers map[string]bool         // map of out transfers, referenced by the object id
-	active       map[string]bool         // stores running transfers
-	challenges   map[string]int64        // store of SENT challenges. key is address, value is sent number
-	connections  map[string]*shared.Peer // stores friend requests until they are accepted / denied
-	recpath      string                  // shortcut to receiving dir
-	temppath     string                  // shortcut to temp dir
+	tin          *Tinzenite          // reference back to Tinzenite
+	mutex        sync.Mutex          // guards the transfer maps, which syncs, repairs and reverts use from their own go routines
+	inTransfers  map[string]transfer // map of in transfers, referenced by transferKey
+	outTransfers map[string]bool     // map of out transfers, referenced by the object id
+	active       map[string]bool     // stores running transfers
+	challenges   map[string]int64    // store of SENT challenges. key is address, value is sent number
+	recpath      string              // shortcut to receiving dir
+	temppath     string              // shortcut to temp dir
 }
 
 func createChannelInterface(t *Tinzenite) *chaninterface {
@@ -34,7 +36,6 @@ func createChannelInterface(t *Tinzenite) *chaninterface {
 		outTransfers: make(map[string]bool),
 		active:       make(map[string]bool),
 		challenges:   make(map[string]int64),
-		connections:  make(map[string]*shared.Peer),
 		recpath:      t.Path + "/" + shared.TINZENITEDIR + "/" + shared.RECEIVINGDIR,
 		temppath:     t.Path + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR}
 }
@@ -46,7 +47,10 @@ OnAllowFile is the callback that checks whether the transfer is to be accepted o
 not. Checks the address and identification of the object against c.transfers.
 */
 func (c *chaninterface) OnAllowFile(address, identification string) (bool, string) {
-	tran, exists := c.inTransfers[identification]
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := transferKey(address, identification)
+	tran, exists := c.inTransfers[key]
 	if !exists {
 		c.log("Transfer not authorized for", identification, "!")
 		return false, ""
@@ -58,7 +62,7 @@ func (c *chaninterface) OnAllowFile(address, identification string) (bool, strin
 	// check timeout
 	if time.Since(tran.updated) > transferTimeout {
 		// c.log("Transfer timed out!")
-		delete(c.inTransfers, identification)
+		delete(c.inTransfers, key)
 		return false, ""
 	}
 	// here accept transfer
@@ -66,7 +70,7 @@ func (c *chaninterface) OnAllowFile(address, identification string) (bool, strin
 	// add to active
 	c.active[address] = true
 	// name is address.identification to allow differentiating between same file from multiple peers
-	return true, c.recpath + "/" + address + "." + identification
+	return true, c.recpath + "/" + key
 }
 
 /*
@@ -75,21 +79,26 @@ received, thus initiates the actual local merging into the model.
 */
 func (c *chaninterface) OnFileReceived(address, path, filename string) {
 	// always free peer here
+	c.mutex.Lock()
 	delete(c.active, address)
-	// split filename to get identification
-	check := strings.Split(filename, ".")[0]
-	identification := strings.Split(filename, ".")[1]
-	if check != address {
+	c.mutex.Unlock()
+	// a sync with an encrypted peer is still alive
+	c.tin.leaseProgress(address)
+	// split filename to get identification, which may itself contain dots
+	parts := strings.SplitN(filename, ".", 2)
+	if len(parts) != 2 || parts[0] != address {
 		c.log("Filename is mismatched!")
 		return
 	}
+	key := transferKey(address, parts[1])
 	/*TODO check request if file is delta / must be decrypted before applying to model*/
-	// get tran
-	tran, exists := c.inTransfers[identification]
+	// get tran and remove it
+	c.mutex.Lock()
+	tran, exists := c.inTransfers[key]
+	delete(c.inTransfers, key)
+	c.mutex.Unlock()
 	if !exists {
 		c.log("Transfer doesn't even exist anymore! Something bad went wrong...")
-		// remove from transfers
-		delete(c.inTransfers, identification)
 		// remove any broken remaining temp files
 		err := os.Remove(c.recpath + "/" + filename)
 		if err != nil {
@@ -97,8 +106,6 @@ func (c *chaninterface) OnFileReceived(address, path, filename string) {
 		}
 		return
 	}
-	// remove transfer
-	delete(c.inTransfers, identification)
 	// move from receiving to temp
 	err := os.Rename(c.recpath+"/"+filename, c.temppath+"/"+filename)
 	if err != nil {
@@ -116,16 +123,8 @@ OnFileCanceled is called when a file transfer is cancelled. In that case we remo
 the associated transfer.
 */
 func (c *chaninterface) OnFileCanceled(address, path string) {
-	// to build the key we require the last element after the last '.'
-	list := strings.Split(path, ".")
-	index := len(list) - 1
-	// keep it sane
-	if index < 0 || index >= len(list) {
-		c.warn("OnFileCanceled: can not delete transfer: index out of range!")
-		return
-	}
-	// the last index string is the identification, so we can delete the transfer
-	delete(c.inTransfers, list[index])
+	// the file is named by the key of the transfer, see OnAllowFile
+	c.dropTransfer(filepath.Base(path))
 }
 
 /*
@@ -134,21 +133,56 @@ that the OTHER peer is bootstrapping: all we need to do here is save the other's
 peer information and include it in the network if allowed.
 */
 func (c *chaninterface) OnFriendRequest(address, message string) {
-	if c.tin.peerValidation == nil {
-		c.warn("PeerValidation() callback is unimplemented, can not connect!")
+	// while joining the network is not known yet, the request is sent again
+	if c.tin.model == nil {
+		c.log("Ignoring friend request while joining.")
+		return
+	}
+	// removed peers are never allowed back in
+	if c.tin.isRevoked(address) {
+		c.log("Ignoring friend request of removed peer", address[:8])
+		return
+	}
+	// denied addresses are not asked about again
+	if c.tin.pending.isDenied(address) {
+		c.log("Ignoring friend request of denied address", address[:8])
 		return
 	}
-	// try to read peer from message
-	peer := &shared.Peer{}
-	err := json.Unmarshal([]byte(message), peer)
+	// try to read peer and presented invite from message
+	peer, token, err := parseFriendRequest(message)
 	if err != nil {
 		// TODO this is for debugging reasons: if non-peer conection attempt handle as trusted peer
 		// FIXME this should result in an error
 		peer, _ = shared.CreatePeer(message, address, true)
 		log.Println("DEBUG: allowing non peer add of peer!")
 	}
-	// remember friend request
-	c.connections[address] = peer
+	// a valid invite is accepted right away at the trust level it was issued for
+	if token != "" {
+		trusted, err := c.tin.redeemInvite(token)
+		if err == nil {
+			c.log("Accepting invited peer", address[:8])
+			peer.Trusted = trusted
+			err = c.tin.acceptPeer(address, peer)
+			if err != nil {
+				c.warn("Failed to accept invited peer:", err.Error())
+			}
+			return
+		}
+		c.warn("Invalid invite presented by", address[:8]+", asking user instead.")
+	}
+	// remember friend request persistently
+	isNew, err := c.tin.pending.add(address, peer)
+	if err != nil {
+		c.warn("Failed to store friend request:", err.Error())
+	}
+	if c.tin.peerValidation == nil {
+		c.warn("PeerValidation() callback is unimplemented, request is kept until answered or expired!")
+		return
+	}
+	// only ask once per request
+	if !isNew {
+		return
+	}
 	// notify of incomming friend request (note that we do this async to not block this thread!)
 	go c.tin.peerValidation(address, peer.Trusted)
 	// NOTE the above go call works because the entire channel stuff runs in a
@@ -161,6 +195,16 @@ process if applicable to clean existing authentication from previous connects.
 */
 func (c *chaninterface) OnConnected(address string) {
 	c.log(address[:8], "came online!")
+	// the peer may have been updated while offline, so negotiate anew
+	c.tin.forgetCapabilities(address)
+	c.tin.markConnected(address)
+	if peer, known := c.tin.peers[address]; known {
+		c.tin.sendHello(address, false)
+		// encrypted peers may have missed changes while offline
+		if !peer.Trusted {
+			c.tin.onEncryptedConnected(address)
+		}
+	}
 	// FIXME: resetting auth prevents trusted bootstrap.
 	/*
 		// we must only reset this if peer is trusted
@@ -184,6 +228,15 @@ func (c *chaninterface) OnConnected(address string) {
 CallbackMessage is called when a message is received.
 */
 func (c *chaninterface) OnMessage(address, message string) {
+	// ignore everything from removed peers
+	if c.tin.isRevoked(address) {
+		return
+	}
+	// core messages are handled separately
+	if msg, isCore := parseCoreMessage(message); isCore {
+		c.onCoreMessage(address, msg)
+		return
+	}
 	// find out type of message
 	v := &shared.Message{}
 	err := json.Unmarshal([]byte(message), v)
@@ -209,6 +262,9 @@ func (c *chaninterface) OnMessage(address, message string) {
 		// differentiate between encrypted and trusted behaviour
 		if !trusted {
 			c.onEncryptedMessage(address, v.Type, message)
+		} else if c.tin.model == nil {
+			// while joining updates can not be applied yet, the first sync fetches them
+			c.log("Ignoring message while joining.")
 		} else {
 			// handle a trusted message
 			c.onTrustedMessage(address, v.Type, message)
@@ -240,6 +296,11 @@ NOTE: this should be the only method that is allowed to send messages to
 UNAUTHENTICATED peers!
 */
 func (c *chaninterface) onAuthenticationMessage(address string, msg shared.AuthenticationMessage) {
+	// while joining a network we can not answer yet
+	if c.tin.auth == nil {
+		c.log("Ignoring authentication while auth is not yet available.")
+		return
+	}
 	// since we need this in either case, do it only once
 	receivedNumber, err := c.tin.auth.ReadAuthentication(&msg)
 	if err != nil {
@@ -264,6 +325,7 @@ func (c *chaninterface) onAuthenticationMessage(address string, msg shared.Authe
 		}
 		// set value
 		c.tin.peers[address].SetAuthenticated(true)
+		c.tin.markAuthenticated(address)
 		// and done
 		return
 	}
@@ -285,6 +347,7 @@ func (c *chaninterface) onAuthenticationMessage(address string, msg shared.Authe
 	}
 	// set value
 	c.tin.peers[address].SetAuthenticated(true)
+	c.tin.markAuthenticated(address)
 	// and done!
 }
 
@@ -296,7 +359,9 @@ called once the send was successful.
 func (c *chaninterface) sendFile(address, path, identification string, f func(channel.State)) error {
 	// we must wrap the function, even if none was given because we'll need to remove the outTransfers
 	newFunction := func(status channel.State) {
+		c.mutex.Lock()
 		delete(c.outTransfers, identification)
+		c.mutex.Unlock()
 		// remember to call the callback
 		if f != nil {
 			f(status)
@@ -306,13 +371,16 @@ func (c *chaninterface) sendFile(address, path, identification string, f func(ch
 		}
 	}
 	// if it already exists, don't restart a new one!
+	c.mutex.Lock()
 	_, exists := c.outTransfers[identification]
 	if exists {
+		c.mutex.Unlock()
 		// receiving side must restart if it so wants to, we'll just keep sending the original one
 		return errors.New("out transfer already exists, will not resend")
 	}
 	// write that the transfer is happening
 	c.outTransfers[identification] = true
+	c.mutex.Unlock()
 	// now call with overwritten function
 	return c.tin.channel.SendFile(address, path, identification, newFunction)
 }
@@ -322,30 +390,30 @@ requestFile requests the given request from the address and executes the functio
 when the transfer was successful. NOTE: only f may be nil.
 */
 func (c *chaninterface) requestFile(address string, rm shared.RequestMessage, f onDone) error {
-	// for all current transfers
-	for identification, trans := range c.inTransfers {
-		// skip if not wanted transfer
-		if identification != rm.Identification {
-			continue
+	key := transferKey(address, rm.Identification)
+	c.mutex.Lock()
+	// if transfer is being served from same address as the new request is sent
+	if trans, exists := c.inTransfers[key]; exists {
+		// check for timeout for retransmit
+		if time.Since(trans.updated) > transferTimeout {
+			// update
+			trans.updated = time.Now()
+			c.inTransfers[key] = trans
+			c.mutex.Unlock()
+			c.log("Retransmiting transfer due to timeout.")
+			// retransmit and done
+			return c.tin.channel.Send(address, rm.JSON())
 		}
-		// if transfer is being served from same address as the new request is sent
-		if trans.active == address {
-			// check for timeout for retransmit
-			if time.Since(trans.updated) > transferTimeout {
-				c.log("Retransmiting transfer due to timeout.")
-				// update
-				trans.updated = time.Now()
-				c.inTransfers[identification] = trans
-				// retransmit and done
-				return c.tin.channel.Send(address, rm.JSON())
-			}
-			// if not yet time for retransmit ignore
-			c.log("Ignoring multiple request for", identification, ".")
-			// and return nil
-			return nil
-		}
-		// if different address we shouldn't request it from somewhere else too
-		c.log("Already fetching file", identification, "from other peer, ignoring!")
+		c.mutex.Unlock()
+		// if not yet time for retransmit ignore
+		c.log("Ignoring multiple request for", rm.Identification, ".")
+		// and return nil
+		return nil
+	}
+	// trusted peers serve the same object, so we shouldn't request it from somewhere else too
+	if other, fetching := c.fetchingFrom(rm.Identification); fetching && c.isTrusted(address) && c.isTrusted(other) {
+		c.mutex.Unlock()
+		c.log("Already fetching file", rm.Identification, "from other peer, ignoring!")
 		/* TODO: add peer address to available peers to fetch update from for
 		fall back purposes. NOTE that we should check if its for the same version
 		of the object however - if not, replace it with more current version. */
@@ -357,22 +425,59 @@ func (c *chaninterface) requestFile(address string, rm shared.RequestMessage, f
 		updated: time.Now(),
 		active:  address,
 		done:    f}
-	c.inTransfers[rm.Identification] = tran
+	c.inTransfers[key] = tran
+	c.mutex.Unlock()
 	// request file from peer
 	return c.tin.channel.Send(address, rm.JSON())
 }
 
+/*
+fetchingFrom returns the address the object is currently being fetched from, if
+any. NOTE: the caller must hold the mutex.
+*/
+func (c *chaninterface) fetchingFrom(identification string) (string, bool) {
+	for key, trans := range c.inTransfers {
+		if key == transferKey(trans.active, identification) {
+			return trans.active, true
+		}
+	}
+	return "", false
+}
+
+/*
+dropTransfer removes the in transfer with the given key, see transferKey.
+*/
+func (c *chaninterface) dropTransfer(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.inTransfers, key)
+}
+
+func (c *chaninterface) isTrusted(address string) bool {
+	peer, exists := c.tin.peers[address]
+	return exists && peer.Trusted
+}
+
 /*
 mergeUpdate does exactly that. First it tries to apply the update. If it fails
 with a merge a merge is done.
 */
 func (c *chaninterface) mergeUpdate(msg shared.UpdateMessage) error {
+	// keep the version that is about to be replaced or removed
+	err := c.tin.keepVersion(&msg)
+	if err != nil {
+		c.warn("Failed to keep previous version:", err.Error())
+	}
 	// try to apply it straight
-	err := c.tin.model.ApplyUpdateMessage(&msg)
+	err = c.tin.model.ApplyUpdateMessage(&msg)
 	// if no error or not merge error, return err
 	if err != shared.ErrConflict {
 		return err
 	}
+	// removals can not be merged: structural conflicts are resolved before applying
+	if msg.Operation == shared.OpRemove {
+		return err
+	}
 	// if merge error --> merge
 	return c.tin.merge(&msg)
 }
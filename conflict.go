@@ -0,0 +1,298 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+resolveStructural checks an incoming update for structural conflicts with the
+local state. These are conflicts that merge can not resolve as they are not
+between two versions of the same file's content: removals of locally edited
+objects and objects that changed between being a file or a directory. The rules
+are that edits always win over removals and that a directory keeps its name
+over a file, while the loser is always kept as a renamed copy. Returns the
+message that is to be applied instead of the given one.
+
+NOTE: all peers resolve these conflicts with the same rules, and the renamed
+copies are given identifications derived from the original object, so that
+copies created independently on different peers will be the same object.
+*/
+func (t *Tinzenite) resolveStructural(msg *shared.UpdateMessage) (*shared.UpdateMessage, error) {
+	relPath := shared.CreatePath(t.Path, msg.Object.Path)
+	switch msg.Operation {
+	case shared.OpRemove:
+		return t.resolveRemove(relPath, msg)
+	case shared.OpModify:
+		// directories are never modified, so only files can conflict here
+		if msg.Object.Directory {
+			return msg, nil
+		}
+		// if we still have the object this is a normal modify
+		if !t.model.IsRemoved(msg.Object.Identification) {
+			return msg, nil
+		}
+		// a modify the removal already included is outdated and left to the model
+		if removed, exists := t.removedVersion(msg.Object.Identification); exists && removed.Includes(msg.Object.Version) {
+			return msg, nil
+		}
+		// otherwise the modification happened concurrently to our removal, so revive it
+		log.Println("Conflict: modify of removed object, reviving", msg.Object.Path, "as copy.")
+		return renameUpdate(msg, REMOVED), nil
+	case shared.OpCreate:
+		return t.resolveKind(relPath, msg)
+	default:
+		return msg, nil
+	}
+}
+
+/*
+resolveRemove handles incoming removals for objects that were modified locally
+since the remote peer last knew of them. If so a renamed copy is kept before the
+removal is applied so that the removal itself can complete on all peers.
+*/
+func (t *Tinzenite) resolveRemove(relPath *shared.RelativePath, msg *shared.UpdateMessage) (*shared.UpdateMessage, error) {
+	// if we don't have the object anymore there is nothing to resolve
+	if _, err := os.Lstat(relPath.FullPath()); err != nil {
+		return msg, nil
+	}
+	// changes within a directory must be found before the model picks them up
+	var unsynced bool
+	if msg.Object.Directory {
+		unsynced = t.hasUnsyncedContent(relPath)
+	}
+	// apply local changes so that unsynchronized edits are visible
+	err := t.model.PartialUpdate(relPath.FullPath())
+	if err != nil {
+		return nil, err
+	}
+	local, err := t.model.GetInfo(relPath)
+	if err != nil {
+		// not tracked, so nothing to resolve
+		return msg, nil
+	}
+	// if the path now holds another object, the model can resolve the removal by identification
+	if local.Identification != msg.Object.Identification {
+		return msg, nil
+	}
+	if local.Directory {
+		// content the remote peer knew of may be removed with the directory
+		if !unsynced {
+			return msg, nil
+		}
+		return msg, t.keepRemovedDirectory(relPath)
+	}
+	// if the remote knew of all our edits the removal is valid
+	if msg.Object.Version.Includes(local.Version) {
+		return msg, nil
+	}
+	log.Println("Conflict: removal of locally edited", relPath.SubPath(), ", keeping copy.")
+	return msg, t.keepCopy(relPath, local, REMOVED)
+}
+
+/*
+resolveKind handles incoming creates for paths where the local object is of
+the other kind. The directory always keeps its name while the file is renamed.
+*/
+func (t *Tinzenite) resolveKind(relPath *shared.RelativePath, msg *shared.UpdateMessage) (*shared.UpdateMessage, error) {
+	stat, err := os.Lstat(relPath.FullPath())
+	// if nothing is in the way there is no conflict
+	if err != nil {
+		return msg, nil
+	}
+	// same kind conflicts are content conflicts and are left to merge
+	if stat.IsDir() == msg.Object.Directory {
+		return msg, nil
+	}
+	// local directory wins: create remote file as renamed copy
+	if stat.IsDir() {
+		log.Println("Conflict: remote file", relPath.SubPath(), "collides with local directory, renaming file.")
+		return renameUpdate(msg, FILE), nil
+	}
+	// remote directory wins: move local file out of the way first
+	log.Println("Conflict: remote directory", relPath.SubPath(), "collides with local file, renaming file.")
+	err = t.model.PartialUpdate(relPath.FullPath())
+	if err != nil {
+		return nil, err
+	}
+	local, err := t.model.GetInfo(relPath)
+	if err != nil {
+		return nil, err
+	}
+	err = t.keepCopy(relPath, local, FILE)
+	if err != nil {
+		return nil, err
+	}
+	// remove original so that the directory can be created
+	err = os.Remove(relPath.FullPath())
+	if err != nil {
+		return nil, err
+	}
+	err = t.model.ApplyRemove(relPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+/*
+keepCopy creates a copy of the local file with the given suffix appended to its
+name and distributes it to all peers.
+*/
+func (t *Tinzenite) keepCopy(relPath *shared.RelativePath, local *shared.ObjectInfo, suffix string) error {
+	obj := *local
+	obj.Objects = nil
+	obj.Identification = conflictIdentifier(local.Identification, local.Content)
+	obj.Name = relPath.LastElement() + suffix
+	obj.Path = relPath.SubPath() + suffix
+	// the model applies creates from the temp dir, so copy the content there
+	tempPath := t.Path + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR + "/" + obj.Identification
+	err := copyFile(relPath.FullPath(), tempPath)
+	if err != nil {
+		return err
+	}
+	err = t.model.ApplyCreate(relPath.Apply(relPath.FullPath()+suffix), &obj)
+	if err != nil {
+		// don't leave orphaned temp files
+		_ = os.Remove(tempPath)
+		return err
+	}
+	// the copy is a change of our own, so distribute it; this may be called
+	// while handling a message, so don't block on the background process
+	um := shared.CreateUpdateMessage(shared.OpCreate, obj)
+	select {
+	case t.sendChannel <- um:
+	default:
+		go func() {
+			t.sendChannel <- um
+		}()
+	}
+	return nil
+}
+
+/*
+removedVersion returns the version the object had when it was removed, as
+recorded in the audit log. Objects removed with their directory have no entry
+of their own.
+*/
+func (t *Tinzenite) removedVersion(identification string) (shared.Version, bool) {
+	entries, err := t.audit.read()
+	if err != nil {
+		log.Println("Conflict: failed to read audit log:", err)
+		return nil, false
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Identification == identification && entry.Operation == shared.OpRemove {
+			return entry.Version, true
+		}
+	}
+	return nil, false
+}
+
+/*
+hasUnsyncedContent returns true if the directory contains objects the model
+doesn't track yet, files changed since the model last saw them, or files edited
+by this peer, which the peer that removed the directory may not have received.
+Content only edited by other peers is removed with the directory.
+*/
+func (t *Tinzenite) hasUnsyncedContent(relPath *shared.RelativePath) bool {
+	root := relPath.FullPath()
+	var unsynced bool
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || unsynced {
+			return filepath.SkipDir
+		}
+		if path == root {
+			return nil
+		}
+		subPath := relPath.SubPath() + strings.TrimPrefix(path, root)
+		stin, exists := t.model.StaticInfos[subPath]
+		if !exists {
+			unsynced = true
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if stin.Version[t.selfpeer.Identification] > 0 {
+			unsynced = true
+			return filepath.SkipDir
+		}
+		hash, err := shared.ContentHash(path)
+		if err != nil || hash != stin.Content {
+			unsynced = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return unsynced
+}
+
+/*
+keepRemovedDirectory keeps the contents of a remotely removed directory that
+holds unsynchronized content, see hasUnsyncedContent. The directory is moved to
+a renamed copy as a local change, which results in the removal of the original
+for the model.
+*/
+func (t *Tinzenite) keepRemovedDirectory(relPath *shared.RelativePath) error {
+	log.Println("Conflict: removal of directory with unsynchronized content", relPath.SubPath(), ", keeping copy.")
+	err := os.Rename(relPath.FullPath(), relPath.FullPath()+REMOVED)
+	if err != nil {
+		return err
+	}
+	// let the model pick up the move as a normal local change
+	return t.model.PartialUpdate(filepath.Dir(relPath.FullPath()))
+}
+
+/*
+renameUpdate returns a copy of the update message turned into a create of a
+renamed copy of the object.
+*/
+func renameUpdate(msg *shared.UpdateMessage, suffix string) *shared.UpdateMessage {
+	renamed := *msg
+	renamed.Operation = shared.OpCreate
+	renamed.Object.Identification = conflictIdentifier(msg.Object.Identification, msg.Object.Content)
+	renamed.Object.Name = msg.Object.Name + suffix
+	renamed.Object.Path = msg.Object.Path + suffix
+	return &renamed
+}
+
+/*
+conflictIdentifier derives the identification of a conflict copy from the
+original object. This guarantees that all peers resolving the same conflict
+create the same object.
+*/
+func conflictIdentifier(identification, content string) string {
+	hash := sha256.Sum256([]byte(identification + ":" + content))
+	return hex.EncodeToString(hash[:16])
+}
+
+/*
+copyFile copies the file at source to destination, overwriting it if it already
+exists.
+*/
+func copyFile(source, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_ModifyVersusRemove(t *testing.T) {
+	network := createTestNetwork(t, 2)
+	defer network.close()
+	one, two := network.peers[0], network.peers[1]
+	network.write(one, "file", "original")
+	network.settle()
+	// two edits while one removes
+	network.write(two, "file", "edited")
+	network.remove(one, "file")
+	removal := network.pending(one)
+	edit := network.pending(two)
+	// removal reaches two first, so the edit must survive as a copy
+	network.deliver(one, two, removal)
+	network.deliver(two, one, edit)
+	network.settle()
+	for _, peer := range network.peers {
+		network.expectMissing(peer, "file")
+		network.expectContent(peer, "file"+REMOVED, "edited")
+	}
+}
+
+func Test_RemoveVersusModify(t *testing.T) {
+	network := createTestNetwork(t, 2)
+	defer network.close()
+	one, two := network.peers[0], network.peers[1]
+	network.write(one, "file", "original")
+	network.settle()
+	network.remove(one, "file")
+	network.write(two, "file", "edited")
+	removal := network.pending(one)
+	edit := network.pending(two)
+	// edit reaches one first, which has already removed the file
+	network.deliver(two, one, edit)
+	network.deliver(one, two, removal)
+	network.settle()
+	for _, peer := range network.peers {
+		network.expectMissing(peer, "file")
+		network.expectContent(peer, "file"+REMOVED, "edited")
+	}
+}
+
+func Test_RemoveDirectoryWithNewFiles(t *testing.T) {
+	network := createTestNetwork(t, 3)
+	defer network.close()
+	one, two := network.peers[0], network.peers[1]
+	network.mkdir(one, "dir")
+	network.write(one, "dir/old", "old")
+	network.settle()
+	// two adds a file while one removes the directory
+	network.write(two, "dir/new", "new")
+	network.remove(one, "dir")
+	removal := network.pending(one)
+	addition := network.pending(two)
+	network.deliver(one, two, removal)
+	network.deliver(two, one, addition)
+	network.settle()
+	for _, peer := range network.peers {
+		network.expectMissing(peer, "dir")
+		network.expectContent(peer, "dir"+REMOVED+"/new", "new")
+	}
+}
+
+func Test_RemoveSyncedDirectory(t *testing.T) {
+	network := createTestNetwork(t, 3)
+	defer network.close()
+	one, two := network.peers[0], network.peers[1]
+	network.mkdir(one, "dir")
+	network.write(one, "dir/old", "old")
+	network.settle()
+	// two knows all of the content, so nothing needs to be kept
+	network.remove(two, "dir")
+	network.settle()
+	for _, peer := range network.peers {
+		network.expectMissing(peer, "dir")
+		network.expectMissing(peer, "dir"+REMOVED)
+	}
+}
+
+func Test_FileVersusDirectory(t *testing.T) {
+	network := createTestNetwork(t, 3)
+	defer network.close()
+	one, two := network.peers[0], network.peers[1]
+	// both create the same name, but of different kind
+	network.write(one, "thing", "file")
+	network.mkdir(two, "thing")
+	network.write(two, "thing/inner", "inner")
+	network.settle()
+	for _, peer := range network.peers {
+		network.expectDirectory(peer, "thing")
+		network.expectContent(peer, "thing/inner", "inner")
+		network.expectContent(peer, "thing"+FILE, "file")
+	}
+}
+
+func Test_RemovedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflict")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	tin := &Tinzenite{
+		selfpeer: &shared.Peer{Identification: "self"},
+		audit:    createAudit(dir + "/" + AUDITLOG)}
+	if _, exists := tin.removedVersion("file"); exists {
+		t.Error("Expected no removal to be known")
+	}
+	obj := shared.ObjectInfo{Path: "file", Identification: "file", Version: shared.Version{"self": 1}}
+	tin.auditLocal(shared.UpdateMessage{Operation: shared.OpModify, Object: obj})
+	obj.Version = shared.Version{"self": 2}
+	tin.auditLocal(shared.UpdateMessage{Operation: shared.OpRemove, Object: obj})
+	removed, exists := tin.removedVersion("file")
+	if !exists || removed["self"] != 2 {
+		t.Error("Expected version of the removal, got", removed, exists)
+	}
+}
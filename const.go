@@ -10,6 +10,17 @@ transferTimeout is the time after which a file is re-requested.
 */
 const transferTimeout = 1 * time.Minute
 
+/*
+joinTimeout is the time a joining peer waits for acceptance and for each of the
+bootstrap files.
+*/
+const joinTimeout = 10 * time.Minute
+
+/*
+pendingTimeout is the time after which an unanswered friend request is dropped.
+*/
+const pendingTimeout = 7 * 24 * time.Hour
+
 /*
 Naming of conflicting files.
 
@@ -17,9 +28,44 @@ TODO: this should be improved because it can quickly cause multi merge
 problems... Consider using name of peers and version numbers.
 */
 const (
-	LOCAL  = ".LOCAL"
-	REMOTE = ".REMOTE"
-	MODEL  = ".MODEL"
+	LOCAL   = ".LOCAL"
+	REMOTE  = ".REMOTE"
+	MODEL   = ".MODEL"
+	REMOVED = ".REMOVED" // edited objects that were concurrently removed elsewhere
+	FILE    = ".FILE"    // files that lost their name to a directory
+)
+
+/*
+Core specific stores. They are placed within the local store directory of the
+Tinzenite directory so that they are never synchronized to other peers.
+*/
+const (
+	HISTORYDIR      = "history"
+	HISTORYINDEX    = "index.json"
+	SNAPSHOTDIR     = "snapshots"
+	SNAPSHOTOBJECTS = "objects"
+	AUDITLOG        = "audit.log"
+	PENDINGFILE     = "pending.json"
+	INVITEFILE      = "invites.json"
+	PEERINFOFILE    = "peerinfo.json"
+	EXCLUDEDFILE    = "excluded.json"
+	LEASEFILE       = "leases.json"
+	MANIFESTFILE    = "manifest.json"
+	JOURNALDIR      = "journals"
+	OUTBOXFILE      = "outbox.json"
+	RESTOREFILE     = "restore.json"
+)
+
+/*
+Core specific org directories. As part of the org directory they are
+synchronized to all peers.
+*/
+const (
+	REVOKEDDIR       = "revoked"
+	ROLESDIR         = "roles"
+	GOVERNANCEFILE   = "governance.json"
+	SUBSCRIPTIONSDIR = "subscriptions"
+	ACLFILE          = "acl.json"
 )
 
 var (
@@ -31,4 +77,28 @@ var (
 	errAuthInvalidPassword = errors.New("password derived keys are incorrect")
 	errPeerUnknown         = errors.New("peer is unknown")
 	errPeerUnauthenticated = errors.New("peer is unauthenticated")
+	errHistoryUnknown      = errors.New("no history exists for path")
+	errHistoryVersion      = errors.New("version not found in history")
+	errSnapshotUnknown     = errors.New("snapshot not found")
+	errSnapshotIncomplete  = errors.New("snapshot content is missing")
+	errGuardNotTripped     = errors.New("no mass change is being held")
+	errAuditTampered       = errors.New("audit log has been tampered with")
+	errPeerRequestUnknown  = errors.New("unknown friend request")
+	errInviteInvalid       = errors.New("invite is invalid, expired or already used")
+	errJoinTimeout         = errors.New("timed out while joining network")
+	errJoinIncomplete      = errors.New("network is missing auth or peers")
+	errNoWriter            = errors.New("no writing peer available")
+	errNotAdmin            = errors.New("peer is not an admin")
+	errQuorumTooLarge      = errors.New("quorum exceeds the number of admins")
+	errNotEncrypted        = errors.New("peer is not an encrypted peer")
+	errPeerOffline         = errors.New("peer is offline")
+	errRepairRunning       = errors.New("repair or audit of peer is already running")
+	errRepairNoModel       = errors.New("encrypted peer holds no model")
+	errRepairTimeout       = errors.New("encrypted peer did not answer in time")
+	errEncryptedLocked     = errors.New("encrypted peer is already locked")
+	errObjectUnknown       = errors.New("object is unknown")
+	errGCNoDryRun          = errors.New("garbage collection requires a dry run first")
+	errRestoreNoAuth       = errors.New("encrypted peer holds no recovery auth, it must be synced by an up to date peer first")
+	errAddressInvalid      = errors.New("address is invalid")
+	errRestoreUnknown      = errors.New("directory was never restored")
 )
@@ -0,0 +1,252 @@
+package core
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+gcGrace is how long unreferenced objects are kept after their upload, as they
+may belong to a sync that is still in progress.
+*/
+const gcGrace = 24 * time.Hour
+
+/*
+GCReport lists the findings of a garbage collection of an encrypted peer.
+*/
+type GCReport struct {
+	Address    string    // address of the encrypted peer
+	DryRun     bool      // whether anything was removed
+	Started    time.Time // start of the collection
+	Finished   time.Time // end of the collection
+	Listed     bool      // whether the encrypted peer listed its objects itself
+	Held       int       // number of objects known to be held by the encrypted peer
+	Referenced int       // number of held objects that are still in use
+	Orphaned   []string  // identifications of unreferenced objects
+	Retained   []string  // identifications of unreferenced objects kept by retention rules
+	Removed    []string  // identifications of objects removed from the encrypted peer
+}
+
+/*
+listingRequest asks an encrypted peer for the objects it holds.
+*/
+type listingRequest struct{}
+
+/*
+listing is the answer of an encrypted peer to a listingRequest.
+*/
+type listing struct {
+	Objects []listedObject
+}
+
+/*
+listedObject is an object held by an encrypted peer.
+*/
+type listedObject struct {
+	Identification string
+	Modified       time.Time // time of the last upload, zero if unknown
+}
+
+/*
+CollectEncrypted looks for objects on the encrypted peer at address that are no
+longer referenced by its model. With dryRun nothing is removed, the report only
+lists what would be. Otherwise only objects reported by the previous dry run are
+removed, so a dry run must always come first. Objects referenced by the local
+model or uploaded within the grace period are retained. NOTE: encrypted peers
+that can't list their objects are described by the manifest, so only objects
+this peer uploaded or saw in their model are found; removals that fail on such
+peers are not noticed. Blocks until done.
+*/
+func (t *Tinzenite) CollectEncrypted(address string, dryRun bool) (*GCReport, error) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return nil, errPeerUnknown
+	}
+	if peer.Trusted {
+		return nil, errNotEncrypted
+	}
+	t.repairs.mutex.Lock()
+	previous, checked := t.repairs.collectable[address]
+	t.repairs.mutex.Unlock()
+	if !dryRun && !checked {
+		return nil, errGCNoDryRun
+	}
+	online, _ := t.channel.IsAddressOnline(address)
+	if !online {
+		return nil, errPeerOffline
+	}
+	job, err := t.startJob(address)
+	if err != nil {
+		return nil, err
+	}
+	defer t.endJob(address, job)
+	err = t.acquireJob(address, job)
+	if err != nil {
+		return nil, err
+	}
+	defer t.releaseLease(address)
+	report := &GCReport{
+		Address: address,
+		DryRun:  dryRun,
+		Started: time.Now()}
+	state, err := t.fetchForeign(address, job)
+	if err != nil {
+		return nil, err
+	}
+	held, listed := t.listEncrypted(address, job)
+	report.Listed = listed
+	if listed {
+		t.pruneManifest(address, held)
+	}
+	report.Held = len(held)
+	// the model, its journals and the recovery auth are always in use
+	referenced := map[string]bool{
+		shared.IDMODEL: true,
+		journalHead:    true,
+		recoveryAuth:   true}
+	for sequence := state.Head.Base + 1; sequence <= state.Head.Sequence; sequence++ {
+		referenced[journalID(sequence)] = true
+	}
+	for _, obj := range state.Objects {
+		referenced[obj.Identification] = true
+	}
+	// mail is in use until its recipient collects it, unless the recipient was removed
+	recipients := make(map[string]bool)
+	for id := range held {
+		if !isMailboxID(id) {
+			continue
+		}
+		recipient := mailboxRecipient(id)
+		if recipients[recipient] {
+			continue
+		}
+		recipients[recipient] = true
+		if other, exists := t.addressOf(recipient); !exists || !t.peers[other].Trusted {
+			continue
+		}
+		index, err := t.fetchMailIndex(address, job, recipient)
+		if err != nil {
+			return nil, err
+		}
+		// batches the index doesn't list were never delivered and can go
+		referenced[mailboxIndexID(recipient)] = true
+		for _, batch := range index.Batches {
+			referenced[batch] = true
+		}
+	}
+	for id, modified := range held {
+		if referenced[id] {
+			report.Referenced++
+			continue
+		}
+		// retention rules: objects we are about to upload and recent uploads
+		if _, err := t.model.GetSubPath(id); err == nil || time.Since(modified) < gcGrace {
+			report.Retained = append(report.Retained, id)
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, id)
+	}
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Retained)
+	if dryRun {
+		orphans := make(map[string]bool)
+		for _, id := range report.Orphaned {
+			orphans[id] = true
+		}
+		t.repairs.mutex.Lock()
+		t.repairs.collectable[address] = orphans
+		t.repairs.mutex.Unlock()
+		report.Finished = time.Now()
+		return report, nil
+	}
+	for _, id := range report.Orphaned {
+		// never remove what the user hasn't seen in a dry run
+		if !previous[id] {
+			continue
+		}
+		nm := shared.CreateNotifyMessage(shared.NoRemoved, id, shared.OtObject)
+		err := t.channel.Send(address, nm.JSON())
+		if err != nil {
+			return nil, err
+		}
+		// listed objects are forgotten once the peer no longer lists them
+		if listed {
+			t.orphanUpload(address, id)
+		} else {
+			t.forgetUpload(address, id)
+		}
+		report.Removed = append(report.Removed, id)
+	}
+	t.repairs.mutex.Lock()
+	delete(t.repairs.collectable, address)
+	t.repairs.mutex.Unlock()
+	report.Finished = time.Now()
+	return report, nil
+}
+
+/*
+listEncrypted returns the objects held by the encrypted peer at address with
+the time of their upload. Peers that can't list their objects are described by
+what we know to have been uploaded to them. Returns true if the peer listed them
+itself.
+*/
+func (t *Tinzenite) listEncrypted(address string, job *repairJob) (map[string]time.Time, bool) {
+	held := make(map[string]time.Time)
+	if t.supports(address, FeatureListing) {
+		message, err := createCoreMessage(coreListing, listingRequest{})
+		if err == nil && t.channel.Send(address, message) == nil {
+			select {
+			case objects := <-job.listing:
+				for _, obj := range objects {
+					held[obj.Identification] = obj.Modified
+				}
+				return held, true
+			case <-time.After(transferTimeout):
+			}
+		}
+	}
+	peer := t.peers[address]
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	for id, entry := range t.manifest.Peers[peer.Identification] {
+		held[id] = entry.Uploaded
+	}
+	return held, false
+}
+
+/*
+pruneManifest forgets the uploads to the encrypted peer at address that it no
+longer lists.
+*/
+func (t *Tinzenite) pruneManifest(address string, held map[string]time.Time) {
+	peer := t.peers[address]
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	uploads := t.manifest.Peers[peer.Identification]
+	for id := range uploads {
+		if _, exists := held[id]; !exists {
+			delete(uploads, id)
+		}
+	}
+	err := t.manifest.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store manifest:", err)
+	}
+}
+
+/*
+onListing passes the listing of an encrypted peer to the running collection.
+*/
+func (t *Tinzenite) onListing(address string, msg listing) {
+	job := t.repairJob(address)
+	if job == nil {
+		return
+	}
+	select {
+	case job.listing <- msg.Objects:
+	default:
+	}
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_CollectRequiresDryRun(t *testing.T) {
+	tin := &Tinzenite{
+		peers: map[string]*shared.Peer{
+			"encryptedpeer": &shared.Peer{Address: "encryptedpeer"},
+			"trustedpeer":   &shared.Peer{Address: "trustedpeer", Trusted: true}},
+		repairs: createRepairs()}
+	if _, err := tin.CollectEncrypted("encryptedpeer", false); err != errGCNoDryRun {
+		t.Error("Expected dry run to be required, got", err)
+	}
+	if _, err := tin.CollectEncrypted("trustedpeer", true); err != errNotEncrypted {
+		t.Error("Expected not encrypted error, got", err)
+	}
+}
+
+func Test_ListingRouting(t *testing.T) {
+	tin := &Tinzenite{repairs: createRepairs()}
+	// without a running collection listings are dropped
+	tin.onListing("encryptedpeer", listing{Objects: []listedObject{{Identification: "object"}}})
+	job, err := tin.startJob("encryptedpeer")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin.onListing("encryptedpeer", listing{Objects: []listedObject{{Identification: "object"}}})
+	select {
+	case objects := <-job.listing:
+		if len(objects) != 1 || objects[0].Identification != "object" {
+			t.Error("Expected listed object, got", objects)
+		}
+	default:
+		t.Error("Expected listing to be passed to the collection")
+	}
+	if _, err := tin.startJob("encryptedpeer"); err != errRepairRunning {
+		t.Error("Expected only one job per peer, got", err)
+	}
+	tin.endJob("encryptedpeer", job)
+}
+
+func Test_PruneManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadManifest(dir + "/" + MANIFESTFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	store.Peers["encryptedID"] = map[string]*manifestEntry{
+		"removed": &manifestEntry{},
+		"failed":  &manifestEntry{}}
+	tin := &Tinzenite{
+		peers:    map[string]*shared.Peer{"encryptedpeer": &shared.Peer{Identification: "encryptedID"}},
+		manifest: store}
+	// removals are kept as orphans until the peer no longer lists them
+	tin.orphanUpload("encryptedpeer", "removed")
+	tin.orphanUpload("encryptedpeer", "failed")
+	if entry := store.Peers["encryptedID"]["removed"]; entry == nil || !entry.Orphaned {
+		t.Error("Expected removed object to be kept as orphan, got", entry)
+	}
+	tin.pruneManifest("encryptedpeer", map[string]time.Time{"failed": time.Now()})
+	if _, exists := store.Peers["encryptedID"]["removed"]; exists {
+		t.Error("Expected object no longer listed to be forgotten")
+	}
+	if _, exists := store.Peers["encryptedID"]["failed"]; !exists {
+		t.Error("Expected object still listed to be kept")
+	}
+}
@@ -0,0 +1,423 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+OrgProposal is a change of the org directory that is held back until enough
+admins have approved it.
+*/
+type OrgProposal struct {
+	ID        string           // identification of the proposal
+	Operation shared.Operation // proposed operation
+	Path      string           // sub path of the changed object
+	Proposer  string           // identification of the admin that made the change
+	Approvers []string         // identifications of the admins that approved it, including the proposer
+	Received  time.Time        // time the change was received
+}
+
+/*
+proposalExpiry is how long approvals are kept for a change that hasn't arrived.
+*/
+const proposalExpiry = 24 * time.Hour
+
+/*
+governanceConfig is the replicated configuration of the governance.
+*/
+type governanceConfig struct {
+	Quorum int // number of admins required for an org change
+}
+
+/*
+proposal is a held org change. The update may be missing if approvals arrive
+before the change itself.
+*/
+type proposal struct {
+	address   string
+	msg       *shared.UpdateMessage
+	proposer  string
+	approvers map[string]bool
+	received  time.Time
+	own       bool // whether this peer made the change, which is then already on disk
+}
+
+/*
+orgApproval is sent by admins to approve a proposal.
+*/
+type orgApproval struct {
+	ID string
+}
+
+/*
+governance restricts changes of the org directory to admin peers. Admins are
+recognized by the address the update arrives from, which the channel
+authenticates. NOTE: as updates are not signed, org changes are only accepted
+directly from admins and never relayed by other peers. Approvals are not signed
+either and are accepted on the address of the approving admin alone.
+*/
+type governance struct {
+	mutex     sync.Mutex
+	quorum    int
+	proposals map[string]*proposal
+	approved  map[string]bool // proposals that may be applied once
+}
+
+func createGovernance() *governance {
+	return &governance{
+		quorum:    1,
+		proposals: make(map[string]*proposal),
+		approved:  make(map[string]bool)}
+}
+
+/*
+SetQuorum sets the number of admins that must approve an org change. The
+setting is distributed to all peers. It can not exceed the number of admins; if
+admins are removed later, all remaining admins are required.
+*/
+func (t *Tinzenite) SetQuorum(quorum int) error {
+	err := t.requireAdmin()
+	if err != nil {
+		return err
+	}
+	if quorum < 1 {
+		quorum = 1
+	}
+	if quorum > 1 && quorum > t.adminCount() {
+		return errQuorumTooLarge
+	}
+	data, err := json.MarshalIndent(governanceConfig{Quorum: quorum}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := t.governancePath()
+	err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	// a held change is loaded once approved
+	if !t.needsApproval() {
+		t.governance.mutex.Lock()
+		t.governance.quorum = quorum
+		t.governance.mutex.Unlock()
+	}
+	return t.model.PartialUpdate(path)
+}
+
+/*
+OrgProposals returns all org changes awaiting approval.
+*/
+func (t *Tinzenite) OrgProposals() []OrgProposal {
+	t.governance.mutex.Lock()
+	defer t.governance.mutex.Unlock()
+	var list []OrgProposal
+	for id, prop := range t.governance.proposals {
+		if prop.msg == nil {
+			continue
+		}
+		list = append(list, prop.export(id))
+	}
+	return list
+}
+
+/*
+ApproveOrgChange approves the proposal as this peer, which must be an admin. The
+approval is sent to all peers.
+*/
+func (t *Tinzenite) ApproveOrgChange(id string) error {
+	if !t.IsAdmin(t.selfpeer.Address) {
+		return errNotAdmin
+	}
+	message, err := createCoreMessage(coreApprove, orgApproval{ID: id})
+	if err != nil {
+		return err
+	}
+	for address := range t.peers {
+		trusted, _ := t.isPeerTrusted(address)
+		// older peers don't understand approvals
+		if !trusted || !t.supports(address, FeatureGovernance) {
+			continue
+		}
+		t.channel.Send(address, message)
+	}
+	t.onApproval(t.selfpeer.Address, id)
+	return nil
+}
+
+/*
+checkOrgUpdate decides whether an update received from address may be applied.
+Returns false if the update is rejected or held for approval.
+*/
+func (t *Tinzenite) checkOrgUpdate(address string, msg *shared.UpdateMessage) bool {
+	if !isOrgPath(msg.Object.Path) || !t.hasAdmins() {
+		return true
+	}
+	// every peer decides itself what it subscribes to
+	if t.isOwnSubscription(address, msg) {
+		return true
+	}
+	if !t.IsAdmin(address) {
+		log.Println("Tinzenite: rejecting org change of", msg.Object.Path, "from non admin", address[:8])
+		return false
+	}
+	id := proposalID(msg)
+	admins := t.adminCount()
+	g := t.governance
+	g.mutex.Lock()
+	quorum := effectiveQuorum(g.quorum, admins)
+	if quorum <= 1 {
+		g.mutex.Unlock()
+		return true
+	}
+	if g.approved[id] {
+		delete(g.approved, id)
+		g.mutex.Unlock()
+		return true
+	}
+	prop, exists := g.proposals[id]
+	if !exists {
+		prop = &proposal{approvers: make(map[string]bool)}
+		g.proposals[id] = prop
+	}
+	isNew := prop.msg == nil
+	prop.address = address
+	prop.msg = msg
+	prop.proposer = t.peers[address].Identification
+	prop.received = time.Now()
+	prop.approvers[prop.proposer] = true
+	ready := len(prop.approvers) >= quorum
+	if ready {
+		delete(g.proposals, id)
+	}
+	exported := prop.export(id)
+	g.mutex.Unlock()
+	if ready {
+		return true
+	}
+	log.Println("Tinzenite: holding org change of", msg.Object.Path, "for approval.")
+	if isNew && t.orgChangeValidation != nil && t.IsAdmin(t.selfpeer.Address) {
+		go t.orgChangeValidation(exported)
+	}
+	return false
+}
+
+/*
+onApproval counts the approval of the admin at address and applies the proposal
+once the quorum is reached.
+*/
+func (t *Tinzenite) onApproval(address, id string) {
+	if !t.IsAdmin(address) {
+		log.Println("Tinzenite: ignoring approval from non admin", address[:8])
+		return
+	}
+	admins := t.adminCount()
+	g := t.governance
+	g.mutex.Lock()
+	prop, exists := g.proposals[id]
+	if !exists {
+		// the change may still arrive, otherwise this expires
+		prop = &proposal{approvers: make(map[string]bool), received: time.Now()}
+		g.proposals[id] = prop
+	}
+	prop.approvers[t.peers[address].Identification] = true
+	if prop.msg == nil || len(prop.approvers) < effectiveQuorum(g.quorum, admins) {
+		g.mutex.Unlock()
+		return
+	}
+	delete(g.proposals, id)
+	if prop.own {
+		g.mutex.Unlock()
+		log.Println("Tinzenite: own org change of", prop.msg.Object.Path, "approved.")
+		err := t.loadOrg()
+		if err != nil {
+			log.Println("Tinzenite: failed to load approved org change:", err)
+		}
+		return
+	}
+	g.approved[id] = true
+	g.mutex.Unlock()
+	log.Println("Tinzenite: org change of", prop.msg.Object.Path, "approved.")
+	err := t.cInterface.handleTrustedMessage(prop.address, prop.msg)
+	if err != nil {
+		log.Println("Tinzenite: failed to apply approved org change:", err)
+	}
+}
+
+/*
+proposeOwn holds an org change made on this peer until enough admins approved
+it, just like the other peers do. It is still sent to them, as they fetch its
+content from this peer once approved. Until then it is only kept on disk.
+*/
+func (t *Tinzenite) proposeOwn(msg shared.UpdateMessage) {
+	if !isOrgPath(msg.Object.Path) || t.isOwnSubscription(t.selfpeer.Address, &msg) || !t.needsApproval() {
+		return
+	}
+	id := proposalID(&msg)
+	g := t.governance
+	g.mutex.Lock()
+	prop, exists := g.proposals[id]
+	if !exists {
+		prop = &proposal{approvers: make(map[string]bool)}
+		g.proposals[id] = prop
+	}
+	prop.address = t.selfpeer.Address
+	prop.msg = &msg
+	prop.own = true
+	prop.proposer = t.selfpeer.Identification
+	prop.received = time.Now()
+	prop.approvers[prop.proposer] = true
+	g.mutex.Unlock()
+	log.Println("Tinzenite: holding own org change of", msg.Object.Path, "for approval.")
+}
+
+/*
+needsApproval returns true if org changes are held until more than one admin
+approved them. Changes of this peer are then only written to disk, and must not
+be applied to the loaded state until approved, see loadOrg.
+*/
+func (t *Tinzenite) needsApproval() bool {
+	admins := t.adminCount()
+	if admins == 0 {
+		return false
+	}
+	t.governance.mutex.Lock()
+	defer t.governance.mutex.Unlock()
+	return effectiveQuorum(t.governance.quorum, admins) > 1
+}
+
+/*
+hasOwnProposals returns true if an org change of this peer awaits approval.
+*/
+func (t *Tinzenite) hasOwnProposals() bool {
+	t.governance.mutex.Lock()
+	defer t.governance.mutex.Unlock()
+	for _, prop := range t.governance.proposals {
+		if prop.own {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+expireProposals drops the approvals of changes that never arrived.
+*/
+func (t *Tinzenite) expireProposals() {
+	t.governance.mutex.Lock()
+	defer t.governance.mutex.Unlock()
+	for id, prop := range t.governance.proposals {
+		if prop.msg == nil && time.Since(prop.received) > proposalExpiry {
+			delete(t.governance.proposals, id)
+		}
+	}
+}
+
+/*
+loadGovernance rereads the replicated governance configuration.
+*/
+func (t *Tinzenite) loadGovernance() error {
+	config := governanceConfig{Quorum: 1}
+	data, err := ioutil.ReadFile(t.governancePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return err
+		}
+	}
+	t.governance.mutex.Lock()
+	t.governance.quorum = config.Quorum
+	t.governance.mutex.Unlock()
+	return nil
+}
+
+/*
+requireAdmin returns errNotAdmin if this peer may not change the org directory.
+*/
+func (t *Tinzenite) requireAdmin() error {
+	if t.hasAdmins() && !t.IsAdmin(t.selfpeer.Address) {
+		return errNotAdmin
+	}
+	return nil
+}
+
+/*
+hasAdmins returns true if any admin exists. Without admins every trusted peer may
+change the org directory.
+*/
+func (t *Tinzenite) hasAdmins() bool {
+	return t.adminCount() > 0
+}
+
+func (t *Tinzenite) adminCount() int {
+	t.roles.mutex.Lock()
+	defer t.roles.mutex.Unlock()
+	count := 0
+	for _, admin := range t.roles.admin {
+		if admin {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+effectiveQuorum returns the quorum limited to the number of admins, so that org
+changes never stall because admins were removed.
+*/
+func effectiveQuorum(quorum, admins int) int {
+	if admins > 0 && quorum > admins {
+		return admins
+	}
+	return quorum
+}
+
+func (p *proposal) export(id string) OrgProposal {
+	exported := OrgProposal{
+		ID:        id,
+		Operation: p.msg.Operation,
+		Path:      p.msg.Object.Path,
+		Proposer:  p.proposer,
+		Received:  p.received}
+	for approver := range p.approvers {
+		exported.Approvers = append(exported.Approvers, approver)
+	}
+	return exported
+}
+
+/*
+proposalID identifies an org change by its content, so that all peers arrive at
+the same identification for the same change.
+*/
+func proposalID(msg *shared.UpdateMessage) string {
+	data, _ := json.Marshal(struct {
+		Operation shared.Operation
+		Object    shared.ObjectInfo
+	}{msg.Operation, msg.Object})
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:16])
+}
+
+/*
+isOrgPath returns true if the sub path lies within the org directory.
+*/
+func isOrgPath(subPath string) bool {
+	orgDir := shared.TINZENITEDIR + "/" + shared.ORGDIR
+	return subPath == orgDir || strings.HasPrefix(subPath, orgDir+"/")
+}
+
+func (t *Tinzenite) governancePath() string {
+	return t.Path + "/" + shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + GOVERNANCEFILE
+}
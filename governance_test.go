@@ -0,0 +1,160 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_CheckOrgUpdate(t *testing.T) {
+	tin := &Tinzenite{
+		selfpeer: &shared.Peer{Identification: "selfID", Address: "selfaddress"},
+		peers: map[string]*shared.Peer{
+			"adminaddress":  {Identification: "adminID", Trusted: true},
+			"otheraddress":  {Identification: "otherID", Trusted: true},
+			"secondaddress": {Identification: "secondID", Trusted: true}},
+		roles:      createRoles(),
+		governance: createGovernance()}
+	orgUpdate := &shared.UpdateMessage{
+		Operation: shared.OpModify,
+		Object:    shared.ObjectInfo{Path: shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + shared.AUTHJSON}}
+	fileUpdate := &shared.UpdateMessage{
+		Operation: shared.OpModify,
+		Object:    shared.ObjectInfo{Path: "file.txt"}}
+	// without admins everyone may change org
+	if !tin.checkOrgUpdate("otheraddress", orgUpdate) {
+		t.Error("Expected org change to pass without admins")
+	}
+	tin.roles.admin["adminID"] = true
+	if tin.checkOrgUpdate("otheraddress", orgUpdate) {
+		t.Error("Expected org change of non admin to be rejected")
+	}
+	if !tin.checkOrgUpdate("otheraddress", fileUpdate) {
+		t.Error("Expected normal change of non admin to pass")
+	}
+	subscriptionDir := shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + SUBSCRIPTIONSDIR
+	ownSubscription := &shared.UpdateMessage{
+		Operation: shared.OpModify,
+		Object:    shared.ObjectInfo{Path: subscriptionDir + "/otherID" + shared.ENDING}}
+	if !tin.checkOrgUpdate("otheraddress", ownSubscription) {
+		t.Error("Expected own subscription of non admin to pass")
+	}
+	foreignSubscription := &shared.UpdateMessage{
+		Operation: shared.OpModify,
+		Object:    shared.ObjectInfo{Path: subscriptionDir + "/adminID" + shared.ENDING}}
+	if tin.checkOrgUpdate("otheraddress", foreignSubscription) {
+		t.Error("Expected subscription of another peer to need an admin")
+	}
+	if !tin.checkOrgUpdate("adminaddress", orgUpdate) {
+		t.Error("Expected org change of admin to pass")
+	}
+	// a quorum larger than the admin count is limited to all admins
+	tin.governance.quorum = 2
+	if !tin.checkOrgUpdate("adminaddress", orgUpdate) {
+		t.Error("Expected quorum to be limited to the single admin")
+	}
+	// with a quorum the change is held
+	tin.roles.admin["secondID"] = true
+	if tin.checkOrgUpdate("adminaddress", orgUpdate) {
+		t.Error("Expected org change to be held for approval")
+	}
+	proposals := tin.OrgProposals()
+	if len(proposals) != 1 || proposals[0].ID != proposalID(orgUpdate) || len(proposals[0].Approvers) != 1 {
+		t.Fatal("Expected one proposal approved by the proposer, got", proposals)
+	}
+	// non admins can not approve
+	tin.onApproval("otheraddress", proposals[0].ID)
+	if len(tin.OrgProposals()[0].Approvers) != 1 {
+		t.Error("Expected approval of non admin to be ignored")
+	}
+}
+
+func Test_EffectiveQuorum(t *testing.T) {
+	if quorum := effectiveQuorum(3, 2); quorum != 2 {
+		t.Error("Expected quorum to be limited to the admins, got", quorum)
+	}
+	if quorum := effectiveQuorum(2, 3); quorum != 2 {
+		t.Error("Expected quorum to remain, got", quorum)
+	}
+	if quorum := effectiveQuorum(2, 0); quorum != 2 {
+		t.Error("Expected quorum to remain without admins, got", quorum)
+	}
+}
+
+func Test_ProposeOwn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "governance")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	tin := &Tinzenite{
+		Path:     dir,
+		selfpeer: &shared.Peer{Identification: "selfID", Address: "selfaddress"},
+		peers: map[string]*shared.Peer{
+			"selfaddress":   {Identification: "selfID", Trusted: true},
+			"secondaddress": {Identification: "secondID", Trusted: true}},
+		revoked:       make(map[string]bool),
+		roles:         createRoles(),
+		governance:    createGovernance(),
+		subscriptions: &subscriptions{},
+		acl:           &acl{}}
+	err = os.MkdirAll(tin.rolePath(), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	for _, id := range []string{"selfID", "secondID"} {
+		data, _ := json.Marshal(peerRole{Identification: id, Admin: true})
+		ioutil.WriteFile(tin.rolePath()+"/"+id+shared.ENDING, data, shared.FILEPERMISSIONMODE)
+	}
+	data, _ := json.Marshal(governanceConfig{Quorum: 2})
+	ioutil.WriteFile(tin.governancePath(), data, shared.FILEPERMISSIONMODE)
+	err = tin.loadOrg()
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	// the own change is on disk but not loaded until approved
+	data, _ = json.Marshal([]ACLRule{{Path: "docs"}})
+	ioutil.WriteFile(tin.aclPath(), data, shared.FILEPERMISSIONMODE)
+	change := shared.UpdateMessage{
+		Operation: shared.OpModify,
+		Object:    shared.ObjectInfo{Path: shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + ACLFILE}}
+	tin.proposeOwn(change)
+	err = tin.loadOrg()
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	if len(tin.ACL()) != 0 {
+		t.Fatal("Expected own change to be held, got", tin.ACL())
+	}
+	proposals := tin.OrgProposals()
+	if len(proposals) != 1 || proposals[0].Proposer != "selfID" {
+		t.Fatal("Expected own proposal, got", proposals)
+	}
+	tin.onApproval("secondaddress", proposals[0].ID)
+	if len(tin.ACL()) != 1 || tin.hasOwnProposals() {
+		t.Error("Expected approved change to be loaded, got", tin.ACL())
+	}
+}
+
+func Test_ExpireProposals(t *testing.T) {
+	tin := &Tinzenite{
+		peers: map[string]*shared.Peer{
+			"adminaddress": {Identification: "adminID", Trusted: true}},
+		roles:      createRoles(),
+		governance: createGovernance()}
+	tin.roles.admin["adminID"] = true
+	tin.onApproval("adminaddress", "unknown")
+	tin.expireProposals()
+	if len(tin.governance.proposals) != 1 {
+		t.Fatal("Expected fresh approval to be kept")
+	}
+	tin.governance.proposals["unknown"].received = time.Now().Add(-2 * proposalExpiry)
+	tin.expireProposals()
+	if len(tin.governance.proposals) != 0 {
+		t.Error("Expected approval of a change that never arrived to expire")
+	}
+}
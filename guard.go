@@ -0,0 +1,319 @@
+package core
+
+import (
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+GuardPolicy configures when the mass change guard pauses synchronization.
+*/
+type GuardPolicy struct {
+	Share   float64       // share of tracked files that may be removed or rewritten within the window
+	Window  time.Duration // window within which changes are counted
+	Minimum int           // minimal number of changes before the guard can trigger
+	Entropy float64       // bits per byte above which a rewritten file is suspicious, zero disables the check
+}
+
+/*
+defaultGuardPolicy is used unless the application sets another one.
+*/
+var defaultGuardPolicy = GuardPolicy{
+	Share:   0.25,
+	Window:  5 * time.Minute,
+	Minimum: 20,
+	Entropy: 7.9}
+
+/*
+entropySample is the number of bytes read of a file to estimate its entropy.
+*/
+const entropySample = 64 * 1024
+
+/*
+heldUpdate is an update held back by the guard, along with the address it came
+from (empty for outgoing updates).
+*/
+type heldUpdate struct {
+	address string
+	msg     shared.UpdateMessage
+}
+
+/*
+guardChange is a single counted removal or rewrite.
+*/
+type guardChange struct {
+	stamp    time.Time
+	removal  bool // whether the change is a removal or a rewrite
+	entropic bool // whether the rewritten content has suspiciously high entropy
+}
+
+/*
+guardSide tracks the changes of one direction of synchronization.
+*/
+type guardSide struct {
+	changes   []guardChange // counted removals and rewrites within the window
+	held      []heldUpdate  // updates held back while tripped
+	tripped   bool          // whether the guard currently holds updates
+	confirmed time.Time     // until when a confirmed mass change may pass unchecked
+}
+
+/*
+guard is the mass change guard. It counts removals and rewrites of files in both
+directions and holds all further updates of a direction once a suspicious
+amount of them happens within the window, until the application confirms or
+rejects them.
+*/
+type guard struct {
+	mutex    sync.Mutex
+	policy   GuardPolicy
+	outgoing guardSide
+	incoming guardSide
+}
+
+func createGuard() *guard {
+	return &guard{policy: defaultGuardPolicy}
+}
+
+/*
+SetGuardPolicy sets the policy of the mass change guard.
+*/
+func (t *Tinzenite) SetGuardPolicy(policy GuardPolicy) {
+	t.guard.mutex.Lock()
+	defer t.guard.mutex.Unlock()
+	t.guard.policy = policy
+}
+
+/*
+ConfirmMassChange releases all updates held by the guard for the given
+direction. Further changes within the window will pass without asking again.
+*/
+func (t *Tinzenite) ConfirmMassChange(incoming bool) error {
+	held, err := t.guard.release(incoming, true)
+	if err != nil {
+		return err
+	}
+	log.Println("Guard: mass change confirmed, releasing", len(held), "updates.")
+	for _, update := range held {
+		if incoming {
+			err := t.cInterface.handleTrustedMessage(update.address, &update.msg)
+			if err != nil {
+				log.Println("Guard: failed to apply released update:", err)
+			}
+		} else {
+			t.broadcast(update.msg)
+		}
+	}
+	return nil
+}
+
+/*
+RejectMassChange discards all updates held by the guard for the given
+direction. NOTE: rejected outgoing changes remain applied locally, so this peer
+will differ from the others until the changes are undone, for example by
+restoring a snapshot. Likewise rejected incoming changes remain applied on the
+peers that sent them, which consider them delivered; the next SyncRemote offers
+them again as the models still differ.
+*/
+func (t *Tinzenite) RejectMassChange(incoming bool) error {
+	held, err := t.guard.release(incoming, false)
+	if err != nil {
+		return err
+	}
+	log.Println("Guard: mass change rejected, discarding", len(held), "updates.")
+	// make the divergence visible, nobody else will notice it
+	senders := make(map[string]int)
+	for _, update := range held {
+		if update.address != "" {
+			senders[update.address]++
+		}
+	}
+	for address, count := range senders {
+		log.Println("Guard: WARNING: this peer now differs from", address[:8], "by", count, "rejected updates.")
+	}
+	if !incoming && len(held) > 0 {
+		log.Println("Guard: WARNING: the other peers now differ from this peer by", len(held), "rejected updates.")
+	}
+	return nil
+}
+
+/*
+holdOutgoing checks a local update before it is sent. Returns true if the update
+is held back.
+*/
+func (t *Tinzenite) holdOutgoing(msg shared.UpdateMessage) bool {
+	var entropic bool
+	if msg.Operation == shared.OpModify && !msg.Object.Directory {
+		entropic = t.guard.isEntropic(t.Path + "/" + msg.Object.Path)
+	}
+	return t.hold(false, "", msg, entropic)
+}
+
+/*
+holdIncoming checks an update received from the given address before it is
+applied. Returns true if the update is held back. NOTE: the content of incoming
+files is not yet available, so only the amount of changes is checked.
+*/
+func (t *Tinzenite) holdIncoming(address string, msg shared.UpdateMessage) bool {
+	return t.hold(true, address, msg, false)
+}
+
+func (t *Tinzenite) hold(incoming bool, address string, msg shared.UpdateMessage, entropic bool) bool {
+	// without a way to ask the user the guard can not be used
+	if t.massChangeValidation == nil {
+		return false
+	}
+	held, trip, removed, rewritten := t.guard.check(incoming, address, msg, entropic, len(t.model.TrackedPaths))
+	if trip {
+		log.Println("Guard: suspicious mass change detected, pausing synchronization.")
+		go t.massChangeValidation(incoming, removed, rewritten)
+	}
+	return held
+}
+
+/*
+check counts the update and decides whether it must be held. Returns whether the
+update was held, whether the guard has just tripped, and the amount of held
+removals and rewrites.
+*/
+func (g *guard) check(incoming bool, address string, msg shared.UpdateMessage, entropic bool, tracked int) (bool, bool, int, int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	side := g.side(incoming)
+	// if already tripped everything is held
+	if side.tripped {
+		side.held = append(side.held, heldUpdate{address: address, msg: msg})
+		return true, false, 0, 0
+	}
+	// only removals and rewrites of files are counted
+	if msg.Object.Directory || (msg.Operation != shared.OpRemove && msg.Operation != shared.OpModify) {
+		return false, false, 0, 0
+	}
+	now := time.Now()
+	// confirmed mass changes pass until the window is over
+	if now.Before(side.confirmed) {
+		return false, false, 0, 0
+	}
+	change := guardChange{
+		stamp:    now,
+		removal:  msg.Operation == shared.OpRemove,
+		entropic: entropic}
+	side.changes = append(withinWindow(side.changes, now, g.policy.Window), change)
+	count := len(side.changes)
+	if count < g.policy.Minimum {
+		return false, false, 0, 0
+	}
+	var removed, rewritten, entropics int
+	for _, counted := range side.changes {
+		if counted.removal {
+			removed++
+		} else {
+			rewritten++
+		}
+		if counted.entropic {
+			entropics++
+		}
+	}
+	tooMany := tracked > 0 && float64(count)/float64(tracked) > g.policy.Share
+	tooEntropic := entropics >= g.policy.Minimum
+	if !tooMany && !tooEntropic {
+		return false, false, 0, 0
+	}
+	side.tripped = true
+	side.held = append(side.held, heldUpdate{address: address, msg: msg})
+	return true, true, removed, rewritten
+}
+
+/*
+release ends a tripped state, returning the held updates. If confirmed, changes
+pass unchecked until the window is over.
+*/
+func (g *guard) release(incoming bool, confirmed bool) ([]heldUpdate, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	side := g.side(incoming)
+	if !side.tripped {
+		return nil, errGuardNotTripped
+	}
+	held := side.held
+	side.held = nil
+	side.tripped = false
+	side.changes = nil
+	if confirmed {
+		side.confirmed = time.Now().Add(g.policy.Window)
+	}
+	return held, nil
+}
+
+func (g *guard) side(incoming bool) *guardSide {
+	if incoming {
+		return &g.incoming
+	}
+	return &g.outgoing
+}
+
+/*
+isEntropic estimates whether the file at path has suspiciously high entropy, as
+is typical for encrypted content.
+*/
+func (g *guard) isEntropic(path string) bool {
+	g.mutex.Lock()
+	limit := g.policy.Entropy
+	g.mutex.Unlock()
+	if limit <= 0 {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	data := make([]byte, entropySample)
+	read, err := io.ReadFull(file, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	// too small files don't allow a meaningful estimate
+	if read < 1024 {
+		return false
+	}
+	return entropy(data[:read]) > limit
+}
+
+/*
+entropy returns the Shannon entropy of data in bits per byte.
+*/
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, value := range data {
+		counts[value]++
+	}
+	var result float64
+	total := float64(len(data))
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		result -= p * math.Log2(p)
+	}
+	return result
+}
+
+/*
+withinWindow returns the changes that lie within the window before now.
+*/
+func withinWindow(changes []guardChange, now time.Time, window time.Duration) []guardChange {
+	var kept []guardChange
+	for _, change := range changes {
+		if now.Sub(change.stamp) <= window {
+			kept = append(kept, change)
+		}
+	}
+	return kept
+}
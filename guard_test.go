@@ -0,0 +1,55 @@
+package core
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_GuardTrips(t *testing.T) {
+	g := createGuard()
+	g.policy = GuardPolicy{Share: 0.5, Window: time.Minute, Minimum: 3}
+	removal := shared.UpdateMessage{Operation: shared.OpRemove}
+	// 2 of 4 files is not more than half
+	for i := 0; i < 2; i++ {
+		if held, _, _, _ := g.check(false, "", removal, false, 4); held {
+			t.Fatal("Expected update to pass")
+		}
+	}
+	held, trip, removed, _ := g.check(false, "", removal, false, 4)
+	if !held || !trip || removed != 3 {
+		t.Fatal("Expected guard to trip with 3 removals, got", held, trip, removed)
+	}
+	// everything after is held, even creates, and incoming is unaffected
+	if held, trip, _, _ := g.check(false, "", shared.UpdateMessage{Operation: shared.OpCreate}, false, 4); !held || trip {
+		t.Error("Expected update to be held without tripping again")
+	}
+	if held, _, _, _ := g.check(true, "", removal, false, 4); held {
+		t.Error("Expected incoming to pass")
+	}
+	list, err := g.release(false, true)
+	if err != nil || len(list) != 2 {
+		t.Fatal("Expected 2 held updates, got", len(list), err)
+	}
+	// confirmed changes pass within the window
+	if held, _, _, _ := g.check(false, "", removal, false, 4); held {
+		t.Error("Expected confirmed change to pass")
+	}
+	if _, err := g.release(false, false); err != errGuardNotTripped {
+		t.Error("Expected error when not tripped, got", err)
+	}
+}
+
+func Test_Entropy(t *testing.T) {
+	random := make([]byte, entropySample)
+	_, _ = rand.Read(random)
+	if value := entropy(random); value < 7.9 {
+		t.Error("Expected random data to have high entropy, got", value)
+	}
+	text := []byte("all work and no play makes jack a dull boy ")
+	if value := entropy(text); value > 5 {
+		t.Error("Expected text to have low entropy, got", value)
+	}
+}
@@ -0,0 +1,233 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tinzenite/model"
+	"github.com/tinzenite/shared"
+)
+
+/*
+testNetwork is a harness of multiple peers that exchange update messages without
+a channel. Files are "transferred" by copying them from the sending peer.
+*/
+type testNetwork struct {
+	t     *testing.T
+	peers []*testPeer
+}
+
+/*
+testPeer is a single peer of a testNetwork. Updates holds all update messages
+the peer has sent that haven't been delivered yet.
+*/
+type testPeer struct {
+	tin     *Tinzenite
+	updates chan shared.UpdateMessage
+}
+
+/*
+createTestNetwork builds a network of count peers, each in its own temporary
+directory. Remember to call close once done.
+*/
+func createTestNetwork(t *testing.T, count int) *testNetwork {
+	network := &testNetwork{t: t}
+	for i := 0; i < count; i++ {
+		path, err := ioutil.TempDir("", "tinzenite")
+		if err != nil {
+			t.Fatal("Failed to create temp dir:", err)
+		}
+		err = shared.MakeTinzeniteDir(path)
+		if err != nil {
+			t.Fatal("Failed to create tinzenite dir:", err)
+		}
+		peerID, err := shared.NewIdentifier()
+		if err != nil {
+			t.Fatal("Failed to create identifier:", err)
+		}
+		m, err := model.Create(path, peerID, path+"/"+shared.STOREMODELDIR)
+		if err != nil {
+			t.Fatal("Failed to create model:", err)
+		}
+		tin := &Tinzenite{
+			Path:          path,
+			selfpeer:      &shared.Peer{Name: path, Address: peerID, Identification: peerID, Trusted: true},
+			model:         m,
+			peers:         make(map[string]*shared.Peer),
+			sendChannel:   make(chan shared.UpdateMessage, 1000),
+			history:       createHistory(path + "/" + shared.STOREMODELDIR + "/" + HISTORYDIR),
+			guard:         createGuard(),
+			audit:         createAudit(path + "/" + shared.STOREMODELDIR + "/" + AUDITLOG),
+			revoked:       make(map[string]bool),
+			roles:         createRoles(),
+			governance:    createGovernance(),
+			capabilities:  createCapabilities(),
+			subscriptions: &subscriptions{path: path + "/" + shared.STOREMODELDIR + "/" + EXCLUDEDFILE, peers: make(map[string]Subscription), Excluded: make(map[string]shared.ObjectInfo)},
+			acl:           &acl{},
+			leases:        &leases{path: path + "/" + shared.STOREMODELDIR + "/" + LEASEFILE, Leases: make(map[string]*lease)},
+			repairs:       createRepairs(),
+			schedule:      createSchedule(),
+			replicas:      createReplicas(),
+			padding:       createPadding(),
+			outbox:        &outbox{path: path + "/" + shared.STOREMODELDIR + "/" + OUTBOXFILE, Queued: make(map[string][]shared.UpdateMessage), Sending: make(map[string]*mailDelivery)},
+			manifest:      &manifest{path: path + "/" + shared.STOREMODELDIR + "/" + MANIFESTFILE, Peers: make(map[string]map[string]*manifestEntry), reports: make(map[string]*AuditReport)},
+			liveness:      &liveness{path: path + "/" + shared.STOREMODELDIR + "/" + PEERINFOFILE, Peers: make(map[string]*peerRecord)}}
+		tin.cInterface = createChannelInterface(tin)
+		m.Register(tin.sendChannel)
+		network.peers = append(network.peers, &testPeer{tin: tin, updates: tin.sendChannel})
+	}
+	return network
+}
+
+/*
+close removes all peer directories.
+*/
+func (n *testNetwork) close() {
+	for _, peer := range n.peers {
+		os.RemoveAll(peer.tin.Path)
+	}
+}
+
+/*
+write the content to the file at the sub path and update the model.
+*/
+func (n *testNetwork) write(peer *testPeer, subPath, content string) {
+	err := ioutil.WriteFile(peer.tin.Path+"/"+subPath, []byte(content), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		n.t.Fatal("Failed to write file:", err)
+	}
+	n.update(peer)
+}
+
+/*
+mkdir creates the directory at the sub path and updates the model.
+*/
+func (n *testNetwork) mkdir(peer *testPeer, subPath string) {
+	err := os.MkdirAll(peer.tin.Path+"/"+subPath, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		n.t.Fatal("Failed to create directory:", err)
+	}
+	n.update(peer)
+}
+
+/*
+remove the object at the sub path and update the model.
+*/
+func (n *testNetwork) remove(peer *testPeer, subPath string) {
+	err := os.RemoveAll(peer.tin.Path + "/" + subPath)
+	if err != nil {
+		n.t.Fatal("Failed to remove object:", err)
+	}
+	n.update(peer)
+}
+
+func (n *testNetwork) update(peer *testPeer) {
+	err := peer.tin.model.Update()
+	if err != nil {
+		n.t.Fatal("Failed to update model:", err)
+	}
+}
+
+/*
+pending returns all updates the peer has sent since the last call.
+*/
+func (n *testNetwork) pending(peer *testPeer) []shared.UpdateMessage {
+	var list []shared.UpdateMessage
+	for {
+		select {
+		case msg := <-peer.updates:
+			list = append(list, msg)
+		default:
+			return list
+		}
+	}
+}
+
+/*
+deliver passes the given updates from one peer to another to
+handleTrustedMessage. The content of files is handed over like mail, so no
+transfer through a channel is required.
+*/
+func (n *testNetwork) deliver(from, to *testPeer, msgs []shared.UpdateMessage) {
+	address := from.tin.selfpeer.Address
+	for _, original := range msgs {
+		msg := original
+		mailed := to.tin.cInterface.mailPath(address, msg.Object.Identification)
+		if !msg.Object.Directory && msg.Operation != shared.OpRemove {
+			subPath, err := from.tin.model.GetSubPath(msg.Object.Identification)
+			if err != nil {
+				n.t.Fatal("Sender doesn't have the object:", err)
+			}
+			err = copyFile(from.tin.Path+"/"+subPath, mailed)
+			if err != nil {
+				n.t.Fatal("Failed to transfer file:", err)
+			}
+		}
+		err := to.tin.cInterface.handleTrustedMessage(address, &msg)
+		if err != nil {
+			n.t.Fatal("Failed to apply update:", err)
+		}
+		// ignored updates leave their content behind
+		os.Remove(mailed)
+	}
+}
+
+/*
+settle delivers all pending updates between all peers until none are left.
+*/
+func (n *testNetwork) settle() {
+	for {
+		var delivered bool
+		for _, from := range n.peers {
+			msgs := n.pending(from)
+			if len(msgs) == 0 {
+				continue
+			}
+			delivered = true
+			for _, to := range n.peers {
+				if to == from {
+					continue
+				}
+				n.deliver(from, to, msgs)
+			}
+		}
+		if !delivered {
+			return
+		}
+	}
+}
+
+/*
+expectContent fails the test if the file at the sub path doesn't have the given
+content.
+*/
+func (n *testNetwork) expectContent(peer *testPeer, subPath, content string) {
+	data, err := ioutil.ReadFile(peer.tin.Path + "/" + subPath)
+	if err != nil {
+		n.t.Error("Expected file", subPath, "to exist:", err)
+		return
+	}
+	if string(data) != content {
+		n.t.Error("Expected", subPath, "to contain", content, "got", string(data))
+	}
+}
+
+/*
+expectMissing fails the test if an object exists at the sub path.
+*/
+func (n *testNetwork) expectMissing(peer *testPeer, subPath string) {
+	if _, err := os.Lstat(peer.tin.Path + "/" + subPath); err == nil {
+		n.t.Error("Expected", subPath, "to not exist!")
+	}
+}
+
+/*
+expectDirectory fails the test if no directory exists at the sub path.
+*/
+func (n *testNetwork) expectDirectory(peer *testPeer, subPath string) {
+	stat, err := os.Lstat(peer.tin.Path + "/" + subPath)
+	if err != nil || !stat.IsDir() {
+		n.t.Error("Expected", subPath, "to be a directory!")
+	}
+}
@@ -0,0 +1,351 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+HistoryPolicy defines how long previous versions of files are kept. A value of
+zero disables the respective limit.
+*/
+type HistoryPolicy struct {
+	MaxVersions int           // maximum number of versions kept per file
+	MaxAge      time.Duration // maximum age of a kept version
+	MaxSize     int64         // maximum total size of all kept versions in bytes
+}
+
+/*
+defaultHistoryPolicy is used unless the application sets another one.
+*/
+var defaultHistoryPolicy = HistoryPolicy{
+	MaxVersions: 10,
+	MaxAge:      30 * 24 * time.Hour,
+	MaxSize:     1 << 30}
+
+/*
+FileVersion describes a single previous version of a file.
+*/
+type FileVersion struct {
+	Version   int              // number of the version, counting up per path
+	Time      time.Time        // time when the version was replaced
+	Size      int64            // size of the content in bytes
+	Content   string           // content hash as tracked by the model
+	Operation shared.Operation // operation that replaced this version
+}
+
+/*
+historyIndex is stored per path and lists all kept versions.
+*/
+type historyIndex struct {
+	Path     string
+	Next     int
+	Versions []FileVersion
+}
+
+/*
+history is the store of previous versions of files. Versions are kept per path
+in a directory named by the hash of the path, containing the index and one
+file per version.
+*/
+type history struct {
+	mutex  sync.Mutex
+	path   string
+	policy HistoryPolicy
+}
+
+func createHistory(path string) *history {
+	return &history{
+		path:   path,
+		policy: defaultHistoryPolicy}
+}
+
+/*
+History returns all kept previous versions of the file at the given path
+(relative to the Tinzenite directory), oldest first.
+*/
+func (t *Tinzenite) History(path string) ([]FileVersion, error) {
+	return t.history.list(shared.CreatePath(t.Path, path).SubPath())
+}
+
+/*
+Restore the given version of the file at path. The current content is itself
+kept in the history first, so a restore can be undone. The restore is applied
+as a normal local modification and thus propagates to all peers.
+*/
+func (t *Tinzenite) Restore(path string, version int) error {
+	relPath := shared.CreatePath(t.Path, path)
+	// load first, as keeping the current content may prune the version
+	data, err := t.history.load(relPath.SubPath(), version)
+	if err != nil {
+		return err
+	}
+	// keep current content if it exists
+	if _, err := os.Lstat(relPath.FullPath()); err == nil {
+		var content string
+		if stin, err := t.model.GetInfo(relPath); err == nil {
+			content = stin.Content
+		}
+		err := t.history.store(relPath.SubPath(), relPath.FullPath(), content, shared.OpModify)
+		if err != nil {
+			return err
+		}
+	}
+	// find top most missing directory so that the model picks up all of them
+	updatePath := relPath.FullPath()
+	for dir := filepath.Dir(updatePath); dir != t.Path; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		updatePath = dir
+	}
+	err = os.MkdirAll(filepath.Dir(relPath.FullPath()), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(relPath.FullPath(), data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	// apply as local change, which will be sent to all peers
+	return t.model.PartialUpdate(updatePath)
+}
+
+/*
+SetHistoryPolicy sets the retention policy of the file history. Takes effect
+with the next pruning.
+*/
+func (t *Tinzenite) SetHistoryPolicy(policy HistoryPolicy) {
+	t.history.mutex.Lock()
+	defer t.history.mutex.Unlock()
+	t.history.policy = policy
+}
+
+/*
+keepVersion stores the current content of the object an update is about to
+replace or remove in the history.
+*/
+func (t *Tinzenite) keepVersion(msg *shared.UpdateMessage) error {
+	// only files that are replaced or removed have a previous version
+	if msg.Object.Directory || (msg.Operation != shared.OpModify && msg.Operation != shared.OpRemove) {
+		return nil
+	}
+	relPath := shared.CreatePath(t.Path, msg.Object.Path)
+	if _, err := os.Lstat(relPath.FullPath()); err != nil {
+		return nil
+	}
+	var content string
+	if stin, err := t.model.GetInfo(relPath); err == nil {
+		content = stin.Content
+	}
+	return t.history.store(relPath.SubPath(), relPath.FullPath(), content, msg.Operation)
+}
+
+/*
+store the file at fullPath as a new version of subPath.
+*/
+func (h *history) store(subPath, fullPath, content string, op shared.Operation) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	dir := h.dirFor(subPath)
+	err := os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	index, err := h.readIndex(dir)
+	if err != nil {
+		return err
+	}
+	index.Path = subPath
+	index.Next++
+	version := FileVersion{
+		Version:   index.Next,
+		Time:      time.Now(),
+		Content:   content,
+		Operation: op}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	version.Size = stat.Size()
+	err = copyFile(fullPath, dir+"/"+versionName(version.Version))
+	if err != nil {
+		return err
+	}
+	index.Versions = append(index.Versions, version)
+	// enforce per path limits right away
+	h.pruneIndex(dir, index)
+	return h.writeIndex(dir, index)
+}
+
+/*
+list returns the versions kept for subPath.
+*/
+func (h *history) list(subPath string) ([]FileVersion, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	index, err := h.readIndex(h.dirFor(subPath))
+	if err != nil {
+		return nil, err
+	}
+	return index.Versions, nil
+}
+
+/*
+load returns the content of the given version of subPath.
+*/
+func (h *history) load(subPath string, version int) ([]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	dir := h.dirFor(subPath)
+	index, err := h.readIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(index.Versions) == 0 {
+		return nil, errHistoryUnknown
+	}
+	for _, kept := range index.Versions {
+		if kept.Version == version {
+			return ioutil.ReadFile(dir + "/" + versionName(version))
+		}
+	}
+	return nil, errHistoryVersion
+}
+
+/*
+prune enforces the policy over the complete history. Age is checked for all
+paths, after which the oldest versions are removed until the total size is
+within the limit.
+*/
+func (h *history) prune() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	dirs, err := ioutil.ReadDir(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// kept version with the directory it resides in
+	type entry struct {
+		dir     string
+		version FileVersion
+	}
+	var all []entry
+	var total int64
+	indices := make(map[string]*historyIndex)
+	for _, stat := range dirs {
+		dir := h.path + "/" + stat.Name()
+		index, err := h.readIndex(dir)
+		if err != nil {
+			return err
+		}
+		h.pruneIndex(dir, index)
+		indices[dir] = index
+		for _, version := range index.Versions {
+			all = append(all, entry{dir: dir, version: version})
+			total += version.Size
+		}
+	}
+	if h.policy.MaxSize > 0 && total > h.policy.MaxSize {
+		// remove oldest first
+		sort.Slice(all, func(i, j int) bool {
+			return all[i].version.Time.Before(all[j].version.Time)
+		})
+		for _, oldest := range all {
+			if total <= h.policy.MaxSize {
+				break
+			}
+			index := indices[oldest.dir]
+			index.Versions = removeVersion(index.Versions, oldest.version.Version)
+			_ = os.Remove(oldest.dir + "/" + versionName(oldest.version.Version))
+			total -= oldest.version.Size
+		}
+	}
+	for dir, index := range indices {
+		// drop directories without any versions left
+		if len(index.Versions) == 0 {
+			_ = os.RemoveAll(dir)
+			continue
+		}
+		err := h.writeIndex(dir, index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+pruneIndex removes all versions of the index that exceed the count or age limit.
+*/
+func (h *history) pruneIndex(dir string, index *historyIndex) {
+	var kept []FileVersion
+	for i, version := range index.Versions {
+		tooMany := h.policy.MaxVersions > 0 && len(index.Versions)-i > h.policy.MaxVersions
+		tooOld := h.policy.MaxAge > 0 && time.Since(version.Time) > h.policy.MaxAge
+		if tooMany || tooOld {
+			_ = os.Remove(dir + "/" + versionName(version.Version))
+			continue
+		}
+		kept = append(kept, version)
+	}
+	index.Versions = kept
+}
+
+func (h *history) readIndex(dir string) (*historyIndex, error) {
+	index := &historyIndex{}
+	data, err := ioutil.ReadFile(dir + "/" + HISTORYINDEX)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (h *history) writeIndex(dir string, index *historyIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir+"/"+HISTORYINDEX, data, shared.FILEPERMISSIONMODE)
+}
+
+/*
+dirFor returns the directory in which the versions of subPath are kept.
+*/
+func (h *history) dirFor(subPath string) string {
+	hash := sha256.Sum256([]byte(subPath))
+	return h.path + "/" + hex.EncodeToString(hash[:])
+}
+
+func versionName(version int) string {
+	return "v" + strconv.Itoa(version)
+}
+
+func removeVersion(versions []FileVersion, version int) []FileVersion {
+	for i, kept := range versions {
+		if kept.Version == version {
+			return append(versions[:i], versions[i+1:]...)
+		}
+	}
+	return versions
+}
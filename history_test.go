@@ -0,0 +1,91 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_HistoryRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	hist := createHistory(dir + "/" + HISTORYDIR)
+	hist.policy = HistoryPolicy{MaxVersions: 2}
+	file := dir + "/file"
+	for _, content := range []string{"one", "two", "three"} {
+		err := ioutil.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			t.Fatal("Expected no error:", err)
+		}
+		err = hist.store("file", file, content, shared.OpModify)
+		if err != nil {
+			t.Fatal("Expected no error:", err)
+		}
+	}
+	versions, err := hist.list("file")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 {
+		t.Fatal("Expected versions 2 and 3 to be kept, got", versions)
+	}
+	data, err := hist.load("file", 3)
+	if err != nil || string(data) != "three" {
+		t.Error("Expected content of version 3, got", string(data), err)
+	}
+	if _, err := hist.load("file", 1); err != errHistoryVersion {
+		t.Error("Expected pruned version to be missing, got", err)
+	}
+	// total size limit removes oldest versions first
+	hist.policy = HistoryPolicy{MaxSize: 5}
+	err = hist.prune()
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	versions, _ = hist.list("file")
+	if len(versions) != 1 || versions[0].Version != 3 {
+		t.Error("Expected only version 3 to remain, got", versions)
+	}
+	// age limit removes everything older
+	hist.policy = HistoryPolicy{MaxAge: time.Nanosecond}
+	time.Sleep(time.Millisecond)
+	err = hist.prune()
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	if _, err := hist.load("file", 3); err != errHistoryUnknown {
+		t.Error("Expected history to be empty, got", err)
+	}
+}
+
+func Test_RestoreUnknownVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	tin := &Tinzenite{Path: dir, history: createHistory(dir + "/" + HISTORYDIR)}
+	file := dir + "/file"
+	err = ioutil.WriteFile(file, []byte("one"), 0644)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	err = tin.history.store("file", file, "one", shared.OpModify)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	// an invalid version must not add the current content to the history
+	if err := tin.Restore("file", 5); err == nil {
+		t.Fatal("Expected unknown version to be refused, got", err)
+	}
+	versions, _ := tin.history.list("file")
+	if len(versions) != 1 {
+		t.Error("Expected history to be unchanged, got", versions)
+	}
+}
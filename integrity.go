@@ -0,0 +1,352 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+auditInterval is how often encrypted peers are audited in the background.
+*/
+const auditInterval = 24 * time.Hour
+
+/*
+auditSample is how many objects are downloaded and checked per audit.
+*/
+const auditSample = 16
+
+/*
+AuditReport lists the findings of an integrity audit of an encrypted peer.
+*/
+type AuditReport struct {
+	Address    string    // address of the encrypted peer
+	Started    time.Time // start of the audit
+	Finished   time.Time // end of the audit
+	Uploaded   int       // number of objects known to have been uploaded
+	Sampled    int       // number of objects downloaded and checked
+	Valid      []string  // sampled paths whose ciphertext matches
+	Missing    []string  // sampled paths the encrypted peer doesn't hold
+	Corrupted  []string  // sampled paths whose ciphertext doesn't match
+	Stale      []string  // paths changed locally since the last upload
+	Unanswered []string  // sampled paths the encrypted peer didn't answer for in time
+}
+
+/*
+manifestEntry records an upload of an object to an encrypted peer.
+*/
+type manifestEntry struct {
+	Hash     string         // sha256 of the uploaded ciphertext
+	Version  shared.Version // version of the object that was uploaded
+	Uploaded time.Time
+	Orphaned bool // whether the model of the peer no longer references it
+}
+
+/*
+manifest is the store of what has been uploaded to which encrypted peer, keyed by
+peer identification and then object identification, along with when each peer
+was last synced. It also keeps the report of the last audit of every peer in
+memory.
+*/
+type manifest struct {
+	mutex   sync.Mutex
+	path    string
+	Peers   map[string]map[string]*manifestEntry
+	Synced  map[string]time.Time    // last completed sync by peer identification
+	reports map[string]*AuditReport // by address
+}
+
+func loadManifest(path string) (*manifest, error) {
+	m := &manifest{
+		path:    path,
+		Peers:   make(map[string]map[string]*manifestEntry),
+		Synced:  make(map[string]time.Time),
+		reports: make(map[string]*AuditReport)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Peers == nil {
+		m.Peers = make(map[string]map[string]*manifestEntry)
+	}
+	if m.Synced == nil {
+		m.Synced = make(map[string]time.Time)
+	}
+	return m, nil
+}
+
+/*
+AuditEncrypted checks the integrity of the encrypted peer at address. A random
+sample of the uploaded objects is downloaded and compared against the hashes of
+what was uploaded; objects that have changed locally since are reported as
+stale. Journals and mail are replaced and removed as part of the normal sync and
+are therefore not sampled. Blocks until done.
+*/
+func (t *Tinzenite) AuditEncrypted(address string) (*AuditReport, error) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return nil, errPeerUnknown
+	}
+	if peer.Trusted {
+		return nil, errNotEncrypted
+	}
+	online, _ := t.channel.IsAddressOnline(address)
+	if !online {
+		return nil, errPeerOffline
+	}
+	job, err := t.startJob(address)
+	if err != nil {
+		return nil, err
+	}
+	defer t.endJob(address, job)
+	err = t.acquireJob(address, job)
+	if err != nil {
+		return nil, err
+	}
+	report := &AuditReport{
+		Address: address,
+		Started: time.Now()}
+	// copy what we need so that uploads may continue meanwhile
+	t.manifest.mutex.Lock()
+	entries := make(map[string]manifestEntry)
+	for id, entry := range t.manifest.Peers[peer.Identification] {
+		// unreferenced objects are left to the garbage collection
+		if !entry.Orphaned {
+			entries[id] = *entry
+		}
+	}
+	t.manifest.mutex.Unlock()
+	report.Uploaded = len(entries)
+	var ids []string
+	for id, entry := range entries {
+		if !isJournalID(id) && !isMailboxID(id) {
+			ids = append(ids, id)
+		}
+		if t.isStale(id, entry) {
+			report.Stale = append(report.Stale, t.auditPath(id))
+		}
+	}
+	for _, id := range sampleIDs(ids, auditSample) {
+		report.Sampled++
+		subPath := t.auditPath(id)
+		ot := t.cInterface.determineObjectTypeBy(subPath)
+		path, missing, err := t.probe(address, job, shared.CreateRequestMessage(ot, id))
+		if err != nil {
+			report.Unanswered = append(report.Unanswered, subPath)
+			continue
+		}
+		if missing {
+			report.Missing = append(report.Missing, subPath)
+			t.forgetUpload(address, id)
+			continue
+		}
+		hash, err := hashFile(path)
+		os.Remove(path)
+		// objects uploaded by other peers can only be checked for presence
+		if err != nil || (entries[id].Hash != "" && hash != entries[id].Hash) {
+			report.Corrupted = append(report.Corrupted, subPath)
+			continue
+		}
+		report.Valid = append(report.Valid, subPath)
+	}
+	t.releaseLease(address)
+	if len(report.Missing) > 0 {
+		t.checkReplicas()
+	}
+	report.Finished = time.Now()
+	t.manifest.mutex.Lock()
+	t.manifest.reports[address] = report
+	t.manifest.mutex.Unlock()
+	return report, nil
+}
+
+/*
+LastAudit returns the report of the last audit of the encrypted peer at address
+since this peer was started, or nil if there was none.
+*/
+func (t *Tinzenite) LastAudit(address string) *AuditReport {
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	return t.manifest.reports[address]
+}
+
+/*
+auditAll audits all online encrypted peers. Called periodically.
+*/
+func (t *Tinzenite) auditAll() {
+	for address, peer := range t.peers {
+		if peer.Trusted {
+			continue
+		}
+		online, _ := t.channel.IsAddressOnline(address)
+		if !online {
+			continue
+		}
+		report, err := t.AuditEncrypted(address)
+		if err != nil {
+			log.Println("Tinzenite: failed to audit encrypted peer", address[:8], ":", err)
+			continue
+		}
+		if len(report.Missing) > 0 || len(report.Corrupted) > 0 || len(report.Stale) > 0 {
+			log.Println("Tinzenite: encrypted peer", address[:8], "has", len(report.Missing), "missing,",
+				len(report.Corrupted), "corrupted and", len(report.Stale), "stale objects, run RepairEncrypted!")
+		}
+	}
+}
+
+/*
+recordUpload notes the successful upload of the ciphertext with the given hash
+to the encrypted peer at address.
+*/
+func (t *Tinzenite) recordUpload(address, identification, hash string) {
+	peer, exists := t.peers[address]
+	if !exists || identification == shared.IDMODEL {
+		return
+	}
+	entry := &manifestEntry{
+		Hash:     hash,
+		Uploaded: time.Now()}
+	if subPath, err := t.model.GetSubPath(identification); err == nil {
+		if stin, exists := t.model.StaticInfos[subPath]; exists {
+			entry.Version = stin.Version
+		}
+	}
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	uploads, exists := t.manifest.Peers[peer.Identification]
+	if !exists {
+		uploads = make(map[string]*manifestEntry)
+		t.manifest.Peers[peer.Identification] = uploads
+	}
+	uploads[identification] = entry
+	err := t.manifest.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store manifest:", err)
+	}
+}
+
+/*
+forgetUpload notes that the object was removed from the encrypted peer.
+*/
+func (t *Tinzenite) forgetUpload(address, identification string) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	delete(t.manifest.Peers[peer.Identification], identification)
+	err := t.manifest.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store manifest:", err)
+	}
+}
+
+/*
+orphanUpload notes that the object was asked to be removed from the encrypted
+peer. The entry is kept for the garbage collection until the encrypted peer no
+longer lists the object, in case the removal fails.
+*/
+func (t *Tinzenite) orphanUpload(address, identification string) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	entry, exists := t.manifest.Peers[peer.Identification][identification]
+	if !exists {
+		return
+	}
+	entry.Orphaned = true
+	err := t.manifest.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store manifest:", err)
+	}
+}
+
+/*
+isStale returns true if the object changed locally since it was uploaded.
+Objects that no longer exist locally are not stale: their removal is handled by
+the next sync.
+*/
+func (t *Tinzenite) isStale(identification string, entry manifestEntry) bool {
+	subPath, err := t.model.GetSubPath(identification)
+	if err != nil {
+		return false
+	}
+	stin, exists := t.model.StaticInfos[subPath]
+	if !exists {
+		return false
+	}
+	return !entry.Version.Includes(stin.Version)
+}
+
+/*
+auditPath returns the sub path of the object for reports, falling back to the
+identification if it isn't known locally.
+*/
+func (t *Tinzenite) auditPath(identification string) string {
+	subPath, err := t.model.GetSubPath(identification)
+	if err != nil {
+		return identification
+	}
+	return subPath
+}
+
+/*
+store writes the manifest to disk. NOTE: the caller must hold the mutex.
+*/
+func (m *manifest) store() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.path, data, shared.FILEPERMISSIONMODE)
+}
+
+/*
+sampleIDs returns up to count randomly chosen identifications.
+*/
+func sampleIDs(ids []string, count int) []string {
+	shuffled := append([]string(nil), ids...)
+	for i := len(shuffled) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	if len(shuffled) > count {
+		shuffled = shuffled[:count]
+	}
+	return shuffled
+}
+
+/*
+hashData returns the hex encoded sha256 of the data.
+*/
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return hashData(data), nil
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_SampleIDs(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+	sample := sampleIDs(ids, 3)
+	if len(sample) != 3 {
+		t.Fatal("Expected 3 sampled ids, got", len(sample))
+	}
+	seen := make(map[string]bool)
+	for _, id := range sample {
+		if seen[id] {
+			t.Error("Expected no id to be sampled twice:", id)
+		}
+		seen[id] = true
+	}
+	if len(sampleIDs(ids, 10)) != len(ids) {
+		t.Error("Expected all ids if fewer than the sample size")
+	}
+	if ids[0] != "a" || ids[4] != "e" {
+		t.Error("Expected ids to not be modified")
+	}
+}
+
+func Test_ManifestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadManifest(dir + "/" + MANIFESTFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	store.Peers["encrypted"] = map[string]*manifestEntry{"object": &manifestEntry{Hash: hashData([]byte("cipher"))}}
+	err = store.store()
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	store, err = loadManifest(dir + "/" + MANIFESTFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	entry, exists := store.Peers["encrypted"]["object"]
+	if !exists || entry.Hash != hashData([]byte("cipher")) {
+		t.Error("Expected upload to be restored, got", entry)
+	}
+	if hashData([]byte("cipher")) == hashData([]byte("other")) {
+		t.Error("Expected different data to hash differently")
+	}
+}
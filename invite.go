@@ -0,0 +1,236 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Invite is the content of an invitation token. Short JSON names keep the token
+compact.
+*/
+type Invite struct {
+	Address string `json:"a"` // address of the inviting peer
+	DirID   string `json:"d"` // identification of the Tinzenite directory
+	Secret  string `json:"s"` // one time secret
+}
+
+/*
+friendRequest is the message sent with a friend request if an invitation token
+is presented. Plain friend requests only contain the peer.
+*/
+type friendRequest struct {
+	Peer   *shared.Peer
+	Invite string
+}
+
+/*
+inviteRecord is what the inviting peer stores for every issued invite.
+*/
+type inviteRecord struct {
+	Trusted bool      // trust level the invited peer will be given
+	Expires time.Time // time after which the invite is no longer valid
+}
+
+/*
+invites is the persistent store of issued and not yet used invites, keyed by
+the hash of their secret.
+*/
+type invites struct {
+	mutex   sync.Mutex
+	path    string
+	Records map[string]inviteRecord
+}
+
+func loadInvites(path string) (*invites, error) {
+	i := &invites{
+		path:    path,
+		Records: make(map[string]inviteRecord)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return i, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, i)
+	if err != nil {
+		return nil, err
+	}
+	if i.Records == nil {
+		i.Records = make(map[string]inviteRecord)
+	}
+	return i, nil
+}
+
+/*
+CreateInvite returns a token that allows a single new peer to join without the
+PeerValidation callback, as trusted or encrypted peer. The token is valid until
+it is used or the ttl has passed.
+*/
+func (t *Tinzenite) CreateInvite(trusted bool, ttl time.Duration) (string, error) {
+	// only admins may add peers
+	err := t.requireAdmin()
+	if err != nil {
+		return "", err
+	}
+	address, err := t.Address()
+	if err != nil {
+		return "", err
+	}
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	invite := Invite{
+		Address: address,
+		DirID:   t.auth.DirID,
+		Secret:  hex.EncodeToString(random)}
+	err = t.invites.add(invite.Secret, inviteRecord{Trusted: trusted, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return "", err
+	}
+	return buildInviteToken(invite)
+}
+
+/*
+buildInviteToken encodes the invite as a compact, URL safe token.
+*/
+func buildInviteToken(invite Invite) (string, error) {
+	data, err := json.Marshal(invite)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+/*
+ParseInvite reads an invitation token, so that a joining peer knows where to
+send its friend request to.
+*/
+func ParseInvite(token string) (*Invite, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInviteInvalid
+	}
+	invite := &Invite{}
+	err = json.Unmarshal(data, invite)
+	if err != nil || invite.Address == "" || invite.Secret == "" {
+		return nil, errInviteInvalid
+	}
+	return invite, nil
+}
+
+/*
+buildFriendRequest builds the friend request message for the peer, presenting
+the token if one is given.
+*/
+func buildFriendRequest(peer *shared.Peer, token string) (string, error) {
+	var data []byte
+	var err error
+	if token == "" {
+		data, err = json.Marshal(peer)
+	} else {
+		data, err = json.Marshal(friendRequest{Peer: peer, Invite: token})
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+/*
+parseFriendRequest reads the peer and the presented token, if any, from a friend
+request message.
+*/
+func parseFriendRequest(message string) (*shared.Peer, string, error) {
+	request := &friendRequest{}
+	err := json.Unmarshal([]byte(message), request)
+	if err == nil && request.Peer != nil {
+		return request.Peer, request.Invite, nil
+	}
+	peer := &shared.Peer{}
+	err = json.Unmarshal([]byte(message), peer)
+	if err != nil {
+		return nil, "", err
+	}
+	return peer, "", nil
+}
+
+/*
+redeemInvite checks the token and burns it if valid. Returns the trust level the
+invite was issued for.
+*/
+func (t *Tinzenite) redeemInvite(token string) (bool, error) {
+	invite, err := ParseInvite(token)
+	if err != nil {
+		return false, err
+	}
+	if invite.DirID != t.auth.DirID {
+		return false, errInviteInvalid
+	}
+	return t.invites.redeem(invite.Secret)
+}
+
+func (i *invites) add(secret string, record inviteRecord) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.expire()
+	i.Records[hashSecret(secret)] = record
+	return i.store()
+}
+
+func (i *invites) redeem(secret string) (bool, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.expire()
+	key := hashSecret(secret)
+	record, exists := i.Records[key]
+	if !exists {
+		return false, errInviteInvalid
+	}
+	// one time only
+	delete(i.Records, key)
+	return record.Trusted, i.store()
+}
+
+/*
+expire drops all expired invites. NOTE: the caller must hold the mutex.
+*/
+func (i *invites) expire() {
+	now := time.Now()
+	for key, record := range i.Records {
+		if now.After(record.Expires) {
+			delete(i.Records, key)
+		}
+	}
+}
+
+/*
+store writes the invites to disk. NOTE: the caller must hold the mutex.
+*/
+func (i *invites) store() error {
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(i.path, data, shared.FILEPERMISSIONMODE)
+}
+
+/*
+hashSecret is used so that the secrets themselves are never stored.
+*/
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
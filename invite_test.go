@@ -0,0 +1,59 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_InviteRedeemOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invite")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadInvites(dir + "/" + INVITEFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{auth: &Authentication{DirID: "dir"}, invites: store}
+	invite := Invite{Address: "address", DirID: "dir", Secret: "secret"}
+	err = store.add(invite.Secret, inviteRecord{Trusted: true, Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	token := encodeTestInvite(t, invite)
+	// the token must survive the friend request message
+	message, err := buildFriendRequest(&shared.Peer{Name: "new"}, token)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	peer, presented, err := parseFriendRequest(message)
+	if err != nil || peer.Name != "new" || presented != token {
+		t.Fatal("Expected peer and token, got", peer, presented, err)
+	}
+	trusted, err := tin.redeemInvite(presented)
+	if err != nil || !trusted {
+		t.Fatal("Expected trusted invite to be redeemed:", err)
+	}
+	if _, err := tin.redeemInvite(presented); err != errInviteInvalid {
+		t.Error("Expected invite to be burned, got", err)
+	}
+	// invites for other directories are refused
+	other := Invite{Address: "address", DirID: "other", Secret: "another"}
+	_ = store.add(other.Secret, inviteRecord{Expires: time.Now().Add(time.Hour)})
+	if _, err := tin.redeemInvite(encodeTestInvite(t, other)); err != errInviteInvalid {
+		t.Error("Expected invite of other directory to be refused, got", err)
+	}
+}
+
+func encodeTestInvite(t *testing.T, invite Invite) string {
+	token, err := buildInviteToken(invite)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	return token
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+joinNetwork sends the friend request to the remote address and bootstraps the
+auth and peer list of the network once it has been accepted. NOTE: must be
+called before the model exists, as no updates can be applied while joining.
+*/
+func (t *Tinzenite) joinNetwork(address, token, password string) error {
+	message, err := buildFriendRequest(t.selfpeer, token)
+	if err != nil {
+		return err
+	}
+	err = t.channel.RequestConnection(address, message)
+	if err != nil {
+		return err
+	}
+	log.Println("Tinzenite: waiting for", address[:8], "to accept.")
+	err = t.awaitAcceptance(address)
+	if err != nil {
+		return err
+	}
+	// fetch the remote model to find the org files
+	path, err := t.fetchFile(address, shared.CreateRequestMessage(shared.OtModel, shared.IDMODEL))
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	os.Remove(path)
+	if err != nil {
+		return err
+	}
+	remoteModel := &shared.ObjectInfo{}
+	err = json.Unmarshal(data, remoteModel)
+	if err != nil {
+		return err
+	}
+	var authID string
+	var peerIDs []string
+	authPath := shared.STOREAUTHDIR + "/" + shared.AUTHJSON
+	remoteModel.ForEach(func(obj shared.ObjectInfo) {
+		if obj.Directory {
+			return
+		}
+		if obj.Path == authPath {
+			authID = obj.Identification
+		} else if strings.HasPrefix(obj.Path, shared.STOREPEERDIR+"/") {
+			peerIDs = append(peerIDs, obj.Identification)
+		}
+	})
+	if authID == "" || len(peerIDs) == 0 {
+		return errJoinIncomplete
+	}
+	// fetch and unlock auth
+	data, err = t.fetchContent(address, authID)
+	if err != nil {
+		return err
+	}
+	auth, err := readAuthentication(data, password)
+	if err != nil {
+		return err
+	}
+	t.auth = auth
+	// fetch all peers
+	for _, id := range peerIDs {
+		data, err := t.fetchContent(address, id)
+		if err != nil {
+			return err
+		}
+		peer := &shared.Peer{}
+		err = json.Unmarshal(data, peer)
+		if err != nil {
+			return err
+		}
+		// never overwrite ourselves
+		if peer.Address == t.selfpeer.Address {
+			continue
+		}
+		t.peers[peer.Address] = peer
+	}
+	remote, exists := t.peers[address]
+	if !exists {
+		return errJoinIncomplete
+	}
+	// the remote accepted us without auth, so we do the same
+	remote.SetAuthenticated(true)
+	return nil
+}
+
+/*
+awaitAcceptance blocks until the remote address comes online, which happens once
+it has accepted the friend request.
+*/
+func (t *Tinzenite) awaitAcceptance(address string) error {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	timeout := time.After(joinTimeout)
+	for {
+		select {
+		case <-ticker.C:
+			online, _ := t.channel.IsAddressOnline(address)
+			if online {
+				return nil
+			}
+		case <-timeout:
+			return errJoinTimeout
+		}
+	}
+}
+
+/*
+fetchFile requests a file and blocks until it has been received. Returns the
+path of the received temp file.
+*/
+func (t *Tinzenite) fetchFile(address string, rm shared.RequestMessage) (string, error) {
+	done := make(chan string, 1)
+	err := t.cInterface.requestFile(address, rm, func(address, path string) {
+		done <- path
+	})
+	if err != nil {
+		return "", err
+	}
+	select {
+	case path := <-done:
+		return path, nil
+	case <-time.After(joinTimeout):
+		return "", errJoinTimeout
+	}
+}
+
+/*
+fetchContent fetches the object with the given identification and returns its
+content, removing the temp file.
+*/
+func (t *Tinzenite) fetchContent(address, identification string) ([]byte, error) {
+	// NOTE: OtObject because OtPeer requests are answered with the remote self peer
+	path, err := t.fetchFile(address, shared.CreateRequestMessage(shared.OtObject, identification))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	return ioutil.ReadFile(path)
+}
@@ -0,0 +1,396 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+The model on encrypted peers is stored as a base, which is the full model stored
+under IDMODEL, plus sequence numbered journals of the changes since. The head
+tells which journals exist. All of them are encrypted objects like any other, so
+the encrypted peer doesn't need to know about them.
+*/
+const (
+	journalHead   = "journal.head"
+	journalPrefix = "journal."
+)
+
+/*
+journalCompaction is the number of journals after which a new base is written.
+*/
+const journalCompaction = 64
+
+/*
+journalHeadInfo is the content of the head.
+*/
+type journalHeadInfo struct {
+	Sequence int // sequence of the latest journal
+	Base     int // sequence the base includes
+}
+
+/*
+journalEntry holds the changes of one sync. Objects are stored without their
+children, keyed by their path.
+*/
+type journalEntry struct {
+	Sequence int
+	Objects  []shared.ObjectInfo // created or changed objects
+	Removed  []string            // paths of removed objects
+}
+
+/*
+journalCache is the state of an encrypted peer as of our last sync with it, so
+that only newer journals must be downloaded. It is stored locally per peer.
+*/
+type journalCache struct {
+	Sequence int
+	Objects  map[string]shared.ObjectInfo
+}
+
+/*
+foreignState is the model of an encrypted peer as read from its base and
+journals.
+*/
+type foreignState struct {
+	Objects map[string]shared.ObjectInfo // all objects by path, without children
+	Head    journalHeadInfo
+	Compact bool // whether the next sync must write a new base
+	Empty   bool // whether the encrypted peer holds no model at all
+}
+
+/*
+fetchForeign reads the model of the encrypted peer at address, downloading only
+the journals that are newer than our cached state of it. NOTE: the peer must be
+locked and job must be registered for it.
+*/
+func (t *Tinzenite) fetchForeign(address string, job *repairJob) (*foreignState, error) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return nil, errPeerUnknown
+	}
+	state := &foreignState{}
+	data, missing, err := t.fetchBlob(address, job, journalHead, shared.OtObject)
+	if err != nil {
+		return nil, err
+	}
+	if missing {
+		// written without journals, so only the base exists
+		state.Compact = true
+	} else {
+		err = json.Unmarshal(data, &state.Head)
+		if err != nil {
+			return nil, err
+		}
+	}
+	from := state.Head.Base
+	cache, err := t.loadJournalCache(peer.Identification)
+	if err != nil {
+		log.Println("Tinzenite: failed to load journal cache:", err)
+	}
+	if !missing && cache != nil && cache.Sequence >= state.Head.Base && cache.Sequence <= state.Head.Sequence {
+		state.Objects = cache.Objects
+		from = cache.Sequence
+	} else {
+		data, missing, err := t.fetchBlob(address, job, shared.IDMODEL, shared.OtModel)
+		if err != nil {
+			return nil, err
+		}
+		state.Objects = make(map[string]shared.ObjectInfo)
+		if missing {
+			state.Empty = true
+			state.Compact = true
+			return state, nil
+		}
+		root := &shared.ObjectInfo{}
+		err = json.Unmarshal(data, root)
+		if err != nil {
+			return nil, err
+		}
+		state.Objects = flattenModel(root)
+	}
+	for sequence := from + 1; sequence <= state.Head.Sequence; sequence++ {
+		data, missing, err := t.fetchBlob(address, job, journalID(sequence), shared.OtObject)
+		if err != nil {
+			return nil, err
+		}
+		if missing {
+			// work with what we have, the next base will replace it
+			log.Println("Tinzenite: journal", sequence, "missing on encrypted peer", address[:8])
+			state.Compact = true
+			break
+		}
+		entry := journalEntry{}
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			return nil, err
+		}
+		entry.apply(state.Objects)
+	}
+	return state, nil
+}
+
+/*
+pushJournal makes the encrypted peer at address match the local model by pushing
+a journal of the changes since state, or a new base if it is time to compact.
+Finally the head is pushed.
+*/
+func (t *Tinzenite) pushJournal(address string, state *foreignState) error {
+	if _, exists := t.peers[address]; !exists {
+		return errPeerUnknown
+	}
+	root, err := t.model.Read()
+	if err != nil {
+		return err
+	}
+	current := flattenModel(root)
+	entry := diffObjects(state.Objects, current)
+	if len(entry.Objects) == 0 && len(entry.Removed) == 0 && !state.Compact {
+		return nil
+	}
+	next := state.Head.Sequence + 1
+	head := journalHeadInfo{Sequence: next, Base: state.Head.Base}
+	var pushed []string
+	if state.Compact || next-state.Head.Base >= journalCompaction {
+		// write the current model as the new base
+		err = t.prepareBlob(address, shared.IDMODEL, root)
+		if err != nil {
+			return err
+		}
+		head.Base = next
+		pushed = append(pushed, shared.IDMODEL)
+	} else {
+		entry.Sequence = next
+		err = t.prepareBlob(address, journalID(next), entry)
+		if err != nil {
+			return err
+		}
+		pushed = append(pushed, journalID(next))
+	}
+	err = t.prepareBlob(address, journalHead, head)
+	if err != nil {
+		return err
+	}
+	pushed = append(pushed, journalHead)
+	for _, id := range pushed {
+		ot := shared.OtObject
+		if id == shared.IDMODEL {
+			ot = shared.OtModel
+		}
+		pm := shared.CreatePushMessage(id, ot)
+		t.expectUpload(address, id)
+		t.channel.Send(address, pm.JSON())
+	}
+	// NOTE: journals included in a new base are left to the garbage collection,
+	// as they are still needed if the upload of the base or head fails
+	t.leases.mutex.Lock()
+	defer t.leases.mutex.Unlock()
+	if held, exists := t.leases.Leases[address]; exists {
+		held.journal = &journalCache{
+			Sequence: next,
+			Objects:  current}
+	}
+	return nil
+}
+
+/*
+headUploaded stores the journal cache of the sync with the encrypted peer at
+address once its head has been uploaded. Until then the cache must stay at the
+previous sequence, as the peer may still hold the old head.
+*/
+func (t *Tinzenite) headUploaded(address string) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	t.leases.mutex.Lock()
+	var cache *journalCache
+	if held, exists := t.leases.Leases[address]; exists {
+		cache = held.journal
+		held.journal = nil
+	}
+	t.leases.mutex.Unlock()
+	if cache == nil {
+		return
+	}
+	err := t.storeJournalCache(peer.Identification, cache)
+	if err != nil {
+		log.Println("Tinzenite: failed to store journal cache:", err)
+	}
+}
+
+/*
+prepareBlob writes the value as the object with the given identification to be
+uploaded to the encrypted peer at address.
+*/
+func (t *Tinzenite) prepareBlob(address, identification string, value interface{}) error {
+	peer, exists := t.peers[address]
+	if !exists {
+		return errPeerUnknown
+	}
+	dir := t.journalPath(peer.Identification)
+	err := os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	return writeJSON(dir+"/"+identification, value)
+}
+
+/*
+clearPrepared removes the objects prepared for an earlier sync with the
+encrypted peer at address, as they have been uploaded or are obsolete.
+*/
+func (t *Tinzenite) clearPrepared(address string) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	os.RemoveAll(t.journalPath(peer.Identification))
+}
+
+/*
+journalBlob returns the path of an object prepared for the encrypted peer at
+address, such as a base, journal or head.
+*/
+func (t *Tinzenite) journalBlob(address, identification string) (string, bool) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return "", false
+	}
+	path := t.journalPath(peer.Identification) + "/" + identification
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+/*
+fetchBlob downloads and decrypts an object from the encrypted peer at address.
+Returns true if the peer doesn't hold it.
+*/
+func (t *Tinzenite) fetchBlob(address string, job *repairJob, identification string, ot shared.ObjectType) ([]byte, bool, error) {
+	path, missing, err := t.probe(address, job, shared.CreateRequestMessage(ot, identification))
+	if err != nil || missing {
+		return nil, missing, err
+	}
+	defer os.Remove(path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err = t.auth.Decrypt(data)
+	if err != nil {
+		return nil, false, err
+	}
+	return unpad(data), false, nil
+}
+
+func (t *Tinzenite) loadJournalCache(identification string) (*journalCache, error) {
+	data, err := ioutil.ReadFile(t.journalPath(identification) + shared.ENDING)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cache := &journalCache{}
+	err = json.Unmarshal(data, cache)
+	if err != nil {
+		return nil, err
+	}
+	if cache.Objects == nil {
+		cache.Objects = make(map[string]shared.ObjectInfo)
+	}
+	return cache, nil
+}
+
+func (t *Tinzenite) storeJournalCache(identification string, cache *journalCache) error {
+	return writeJSON(t.journalPath(identification)+shared.ENDING, cache)
+}
+
+func (t *Tinzenite) journalPath(identification string) string {
+	return t.Path + "/" + shared.STOREMODELDIR + "/" + JOURNALDIR + "/" + identification
+}
+
+/*
+apply changes the objects according to the journal entry.
+*/
+func (e *journalEntry) apply(objects map[string]shared.ObjectInfo) {
+	for _, removed := range e.Removed {
+		delete(objects, removed)
+	}
+	for _, obj := range e.Objects {
+		objects[obj.Path] = obj
+	}
+}
+
+/*
+diffObjects returns the journal entry that turns from into to.
+*/
+func diffObjects(from, to map[string]shared.ObjectInfo) journalEntry {
+	entry := journalEntry{}
+	for path, obj := range to {
+		old, exists := from[path]
+		if !exists || !reflect.DeepEqual(old, obj) {
+			entry.Objects = append(entry.Objects, obj)
+		}
+	}
+	for path := range from {
+		if _, exists := to[path]; !exists {
+			entry.Removed = append(entry.Removed, path)
+		}
+	}
+	return entry
+}
+
+/*
+flattenModel returns all objects of the model by path, without their children.
+*/
+func flattenModel(root *shared.ObjectInfo) map[string]shared.ObjectInfo {
+	objects := make(map[string]shared.ObjectInfo)
+	root.ForEach(func(obj shared.ObjectInfo) {
+		obj.Objects = nil
+		objects[obj.Path] = obj
+	})
+	return objects
+}
+
+/*
+isJournalID returns true for the identifications of journals and the head.
+*/
+func isJournalID(identification string) bool {
+	return strings.HasPrefix(identification, journalPrefix)
+}
+
+/*
+isLiveJournal returns true if the journal is the head or listed by it.
+*/
+func isLiveJournal(identification string, head journalHeadInfo) bool {
+	if identification == journalHead {
+		return true
+	}
+	sequence, err := strconv.Atoi(strings.TrimPrefix(identification, journalPrefix))
+	if err != nil {
+		return false
+	}
+	return sequence > head.Base && sequence <= head.Sequence
+}
+
+func journalID(sequence int) string {
+	return journalPrefix + strconv.Itoa(sequence)
+}
+
+func writeJSON(path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
+}
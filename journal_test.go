@@ -0,0 +1,78 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_JournalDiffApply(t *testing.T) {
+	from := map[string]shared.ObjectInfo{
+		"kept":    shared.ObjectInfo{Path: "kept", Identification: "1"},
+		"changed": shared.ObjectInfo{Path: "changed", Identification: "2", Version: shared.Version{"a": 1}},
+		"removed": shared.ObjectInfo{Path: "removed", Identification: "3"}}
+	to := map[string]shared.ObjectInfo{
+		"kept":    shared.ObjectInfo{Path: "kept", Identification: "1"},
+		"changed": shared.ObjectInfo{Path: "changed", Identification: "2", Version: shared.Version{"a": 2}},
+		"created": shared.ObjectInfo{Path: "created", Identification: "4"}}
+	entry := diffObjects(from, to)
+	if len(entry.Objects) != 2 || len(entry.Removed) != 1 || entry.Removed[0] != "removed" {
+		t.Fatal("Expected two changed and one removed object, got", entry)
+	}
+	entry.apply(from)
+	if !reflect.DeepEqual(from, to) {
+		t.Error("Expected applied journal to result in the new state, got", from)
+	}
+	if len(diffObjects(to, to).Objects) != 0 {
+		t.Error("Expected no changes between equal states")
+	}
+}
+
+func Test_JournalID(t *testing.T) {
+	if journalID(12) != "journal.12" {
+		t.Error("Expected sequence in journal id, got", journalID(12))
+	}
+	head := journalHeadInfo{Sequence: 5, Base: 3}
+	if !isLiveJournal(journalHead, head) || !isLiveJournal(journalID(4), head) || !isLiveJournal(journalID(5), head) {
+		t.Error("Expected head and journals after the base to be live")
+	}
+	if isLiveJournal(journalID(3), head) || isLiveJournal(journalID(6), head) {
+		t.Error("Expected journals included in the base to not be live")
+	}
+}
+
+func Test_JournalCacheAfterHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadLeases(dir + "/" + LEASEFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{
+		Path:   dir,
+		peers:  map[string]*shared.Peer{"encrypted": {Identification: "encryptedID"}},
+		leases: store}
+	err = os.MkdirAll(tin.journalPath("encryptedID"), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	store.Leases["encrypted"] = &lease{
+		expected: make(map[string]bool),
+		journal:  &journalCache{Sequence: 3, Objects: make(map[string]shared.ObjectInfo)}}
+	// the cache only moves once the head is uploaded
+	cache, err := tin.loadJournalCache("encryptedID")
+	if err != nil || cache != nil {
+		t.Fatal("Expected no cache before the head was uploaded, got", cache, err)
+	}
+	tin.headUploaded("encrypted")
+	cache, err = tin.loadJournalCache("encryptedID")
+	if err != nil || cache == nil || cache.Sequence != 3 {
+		t.Error("Expected cache of the uploaded head, got", cache, err)
+	}
+}
@@ -0,0 +1,360 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+leaseDuration is how long a lock on an encrypted peer is valid without renewal.
+*/
+const leaseDuration = 2 * time.Minute
+
+/*
+leaseRenewal is how often held leases are renewed.
+*/
+const leaseRenewal = 30 * time.Second
+
+/*
+leaseMessage announces the lease that accompanies a lock, so that the encrypted
+peer can break it once it expires. It is sent with every request and renewal,
+but only to encrypted peers that announced FeatureLease. NOTE: all other
+encrypted peers only know the plain lock, so a lock held by a peer that died is
+only released once that peer starts again and releases its persisted leases.
+*/
+type leaseMessage struct {
+	ID       string        // identification of the lease
+	Owner    string        // identification of the peer holding the lease
+	Duration time.Duration // time from now until the lease expires
+}
+
+/*
+lease is a lock on an encrypted peer held by this peer.
+*/
+type lease struct {
+	ID       string          // identification of the lease
+	Expires  time.Time       // time the lease expires unless renewed
+	acquired bool            // whether the encrypted peer has accepted the lock
+	pushed   bool            // whether all pushes of the sync have been sent
+	expected map[string]bool // identifications of pushed objects not yet uploaded
+	failed   int             // number of uploads that failed
+	progress time.Time       // last time the sync made progress
+	journal  *journalCache   // journal cache to store once the head has been uploaded
+}
+
+/*
+leases tracks the locks on encrypted peers. They are persisted so that locks of
+a crashed run can be released on the next start.
+*/
+type leases struct {
+	mutex  sync.Mutex
+	path   string
+	Leases map[string]*lease // by address
+}
+
+func loadLeases(path string) (*leases, error) {
+	l := &leases{
+		path:   path,
+		Leases: make(map[string]*lease)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, err
+	}
+	if l.Leases == nil {
+		l.Leases = make(map[string]*lease)
+	}
+	// leases of an earlier run are stale: they are released once possible
+	for _, old := range l.Leases {
+		old.acquired = true
+		old.pushed = true
+		old.Expires = time.Time{}
+		old.expected = make(map[string]bool)
+	}
+	return l, nil
+}
+
+/*
+requestLease sends a lock request along with a new lease to the encrypted peer
+at address.
+*/
+func (t *Tinzenite) requestLease(address string) error {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	t.leases.mutex.Lock()
+	held := &lease{
+		ID:       hex.EncodeToString(random),
+		Expires:  now.Add(leaseDuration),
+		expected: make(map[string]bool),
+		progress: now}
+	t.leases.Leases[address] = held
+	err = t.leases.store()
+	t.leases.mutex.Unlock()
+	if err != nil {
+		log.Println("Tinzenite: failed to store leases:", err)
+	}
+	lm := shared.CreateLockMessage(shared.LoRequest)
+	err = t.channel.Send(address, lm.JSON())
+	if err != nil {
+		return err
+	}
+	t.sendLease(address, held.ID)
+	return nil
+}
+
+/*
+acquiredLease is called once the encrypted peer accepted the lock.
+*/
+func (t *Tinzenite) acquiredLease(address string) {
+	t.leases.mutex.Lock()
+	defer t.leases.mutex.Unlock()
+	held, exists := t.leases.Leases[address]
+	if !exists {
+		// accepted without a request of ours, so track it to be able to release it
+		held = &lease{expected: make(map[string]bool)}
+		t.leases.Leases[address] = held
+	}
+	held.acquired = true
+	held.progress = time.Now()
+	held.Expires = held.progress.Add(leaseDuration)
+}
+
+/*
+expectUpload notes that a push for the object was sent to the encrypted peer,
+which will then request it.
+*/
+func (t *Tinzenite) expectUpload(address, identification string) {
+	t.leases.mutex.Lock()
+	defer t.leases.mutex.Unlock()
+	if held, exists := t.leases.Leases[address]; exists {
+		held.expected[identification] = true
+	}
+}
+
+/*
+pushedAll notes that all pushes of the sync have been sent. Releases the lease
+if no uploads are outstanding.
+*/
+func (t *Tinzenite) pushedAll(address string) {
+	t.leases.mutex.Lock()
+	held, exists := t.leases.Leases[address]
+	if exists {
+		held.pushed = true
+	}
+	done := exists && len(held.expected) == 0
+	var failed int
+	if exists {
+		failed = held.failed
+	}
+	t.leases.mutex.Unlock()
+	if done {
+		t.finishSync(address, failed)
+	}
+}
+
+/*
+uploaded notes that an upload to the encrypted peer has completed, successfully
+or not. Releases the lease as soon as the last upload is done.
+*/
+func (t *Tinzenite) uploaded(address, identification string, success bool) {
+	t.leases.mutex.Lock()
+	held, exists := t.leases.Leases[address]
+	var failed int
+	if exists {
+		delete(held.expected, identification)
+		held.progress = time.Now()
+		if !success {
+			held.failed++
+		}
+		failed = held.failed
+	}
+	done := exists && held.pushed && len(held.expected) == 0
+	t.leases.mutex.Unlock()
+	if done {
+		t.finishSync(address, failed)
+	}
+}
+
+/*
+finishSync releases the lease once all uploads of the sync with the encrypted
+peer at address are done. The sync only counts as completed if none of them
+failed.
+*/
+func (t *Tinzenite) finishSync(address string, failed int) {
+	t.releaseLease(address)
+	if failed > 0 {
+		t.encryptedFailed(address, strconv.Itoa(failed)+" uploads failed")
+		return
+	}
+	t.encryptedSynced(address)
+	t.recordSync(address)
+	t.markSynced(address)
+	t.checkReplicas()
+}
+
+/*
+leaseProgress notes that the sync with the encrypted peer at address is still
+making progress, for example because a file was received from it.
+*/
+func (t *Tinzenite) leaseProgress(address string) {
+	t.leases.mutex.Lock()
+	defer t.leases.mutex.Unlock()
+	if held, exists := t.leases.Leases[address]; exists {
+		held.progress = time.Now()
+	}
+}
+
+/*
+releaseLease sends the release to the encrypted peer and drops the lease.
+*/
+func (t *Tinzenite) releaseLease(address string) {
+	ulm := shared.CreateLockMessage(shared.LoRelease)
+	err := t.channel.Send(address, ulm.JSON())
+	if err != nil {
+		// keep it so that the release is sent again later
+		log.Println("Tinzenite: failed to send release:", err)
+		return
+	}
+	t.dropLease(address)
+}
+
+/*
+dropLease forgets the lease without notifying the encrypted peer, for example
+because it has released the lock itself.
+*/
+func (t *Tinzenite) dropLease(address string) {
+	if peer, exists := t.peers[address]; exists {
+		peer.SetLocked(false)
+	}
+	t.leases.mutex.Lock()
+	defer t.leases.mutex.Unlock()
+	delete(t.leases.Leases, address)
+	err := t.leases.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store leases:", err)
+	}
+}
+
+/*
+hasLease returns true if this peer holds or has requested a lease on the
+encrypted peer at address.
+*/
+func (t *Tinzenite) hasLease(address string) bool {
+	t.leases.mutex.Lock()
+	defer t.leases.mutex.Unlock()
+	_, exists := t.leases.Leases[address]
+	return exists
+}
+
+/*
+isLeaseStale returns true if the lease on the encrypted peer at address has
+expired or the sync made no progress for the lease duration.
+*/
+func (t *Tinzenite) isLeaseStale(address string) bool {
+	t.leases.mutex.Lock()
+	defer t.leases.mutex.Unlock()
+	held, exists := t.leases.Leases[address]
+	if !exists {
+		// locked without a lease of ours
+		return true
+	}
+	return held.isStale(time.Now())
+}
+
+/*
+renewLeases is called periodically. It renews all leases that are still making
+progress and breaks stale ones by releasing them. Requests that were never
+accepted are dropped silently.
+*/
+func (t *Tinzenite) renewLeases() {
+	now := time.Now()
+	var stale, unanswered []string
+	renew := make(map[string]string)
+	t.leases.mutex.Lock()
+	for address, held := range t.leases.Leases {
+		// never release a lock we don't hold, it may belong to another peer
+		if !held.acquired {
+			if held.isStale(now) {
+				unanswered = append(unanswered, address)
+			}
+			continue
+		}
+		if held.isStale(now) {
+			stale = append(stale, address)
+			continue
+		}
+		held.Expires = now.Add(leaseDuration)
+		renew[address] = held.ID
+	}
+	err := t.leases.store()
+	t.leases.mutex.Unlock()
+	if err != nil {
+		log.Println("Tinzenite: failed to store leases:", err)
+	}
+	for address, id := range renew {
+		t.sendLease(address, id)
+	}
+	for _, address := range unanswered {
+		t.dropLease(address)
+		t.encryptedFailed(address, "lock was not granted")
+	}
+	for _, address := range stale {
+		online, _ := t.channel.IsAddressOnline(address)
+		if !online {
+			continue
+		}
+		log.Println("Tinzenite: breaking stale lease on", address[:8])
+		t.releaseLease(address)
+		t.encryptedFailed(address, "sync made no progress")
+	}
+}
+
+func (t *Tinzenite) sendLease(address, id string) {
+	// encrypted peers that don't know leases can't use them
+	if !t.supports(address, FeatureLease) {
+		return
+	}
+	message, err := createCoreMessage(coreLease, leaseMessage{
+		ID:       id,
+		Owner:    t.selfpeer.Identification,
+		Duration: leaseDuration})
+	if err != nil {
+		log.Println("Tinzenite: failed to build lease:", err)
+		return
+	}
+	t.channel.Send(address, message)
+}
+
+func (l *lease) isStale(now time.Time) bool {
+	return now.After(l.Expires) || now.Sub(l.progress) > leaseDuration
+}
+
+/*
+store writes the leases to disk. NOTE: the caller must hold the mutex.
+*/
+func (l *leases) store() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path, data, shared.FILEPERMISSIONMODE)
+}
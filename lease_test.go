@@ -0,0 +1,55 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_LeaseTracking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadLeases(dir + "/" + LEASEFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{leases: store}
+	now := time.Now()
+	store.Leases["encrypted"] = &lease{ID: "lease", Expires: now.Add(leaseDuration), expected: make(map[string]bool), progress: now}
+	tin.acquiredLease("encrypted")
+	tin.expectUpload("encrypted", "one")
+	tin.expectUpload("encrypted", "two")
+	tin.pushedAll("encrypted")
+	tin.uploaded("encrypted", "one", true)
+	held := store.Leases["encrypted"]
+	if !held.acquired || !held.pushed || len(held.expected) != 1 {
+		t.Fatal("Expected lease to await one upload, got", held)
+	}
+	if tin.isLeaseStale("encrypted") {
+		t.Error("Expected active lease to not be stale")
+	}
+	held.progress = now.Add(-2 * leaseDuration)
+	if !tin.isLeaseStale("encrypted") {
+		t.Error("Expected lease without progress to be stale")
+	}
+	if !tin.isLeaseStale("unknown") {
+		t.Error("Expected lock without lease to be stale")
+	}
+	// leases of an earlier run are stale after a restart
+	err = store.store()
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	store, err = loadLeases(dir + "/" + LEASEFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin.leases = store
+	if old, exists := store.Leases["encrypted"]; !exists || old.ID != "lease" || !old.acquired || !tin.isLeaseStale("encrypted") {
+		t.Error("Expected persisted lease to be loaded as stale, got", old)
+	}
+}
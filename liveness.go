@@ -0,0 +1,257 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+PeerInfo is everything known about a peer and its connection to this peer.
+*/
+type PeerInfo struct {
+	Address           string        // address of the peer
+	Name              string        // name of the peer
+	Identification    string        // identification of the peer
+	Trusted           bool          // whether the peer is trusted or encrypted
+	Online            bool          // whether the peer is currently online
+	LastConnected     time.Time     // last time the peer came online
+	LastDisconnected  time.Time     // last time the peer was seen going offline
+	LastSync          time.Time     // last successful model sync with the peer
+	LastAuthenticated time.Time     // last successful authentication of the peer
+	Latency           time.Duration // round trip time of the last ping, zero if unknown
+}
+
+/*
+peerRecord is the persisted liveness data of a peer.
+*/
+type peerRecord struct {
+	LastConnected     time.Time
+	LastDisconnected  time.Time
+	LastSync          time.Time
+	LastAuthenticated time.Time
+	Latency           time.Duration
+	online            bool
+}
+
+/*
+ping is sent periodically to measure the round trip time. The answer carries
+the same content with Pong set.
+*/
+type ping struct {
+	Sent time.Time // time of sending, by the clock of the pinging peer
+	Pong bool
+}
+
+/*
+liveness is the persistent store of the liveness data of all peers, keyed by
+their identification. It is kept locally as it describes what this peer has
+observed. NOTE: it is deliberately not stored next to the peer files in the org
+directory: every connect and ping would then be an org change, sent to all
+peers and held for approval under governance.
+*/
+type liveness struct {
+	mutex sync.Mutex
+	path  string
+	Peers map[string]*peerRecord
+}
+
+func loadLiveness(path string) (*liveness, error) {
+	l := &liveness{
+		path:  path,
+		Peers: make(map[string]*peerRecord)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, err
+	}
+	if l.Peers == nil {
+		l.Peers = make(map[string]*peerRecord)
+	}
+	return l, nil
+}
+
+/*
+PeerInfo returns what is known about the peer at address.
+*/
+func (t *Tinzenite) PeerInfo(address string) (PeerInfo, error) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return PeerInfo{}, errPeerUnknown
+	}
+	return t.peerInfo(peer), nil
+}
+
+/*
+PeerInfos returns what is known about all peers except this one.
+*/
+func (t *Tinzenite) PeerInfos() []PeerInfo {
+	var list []PeerInfo
+	for _, peer := range t.peers {
+		if peer.Identification == t.selfpeer.Identification {
+			continue
+		}
+		list = append(list, t.peerInfo(peer))
+	}
+	return list
+}
+
+func (t *Tinzenite) peerInfo(peer *shared.Peer) PeerInfo {
+	info := PeerInfo{
+		Address:        peer.Address,
+		Name:           peer.Name,
+		Identification: peer.Identification,
+		Trusted:        peer.Trusted}
+	t.liveness.mutex.Lock()
+	defer t.liveness.mutex.Unlock()
+	record, exists := t.liveness.Peers[peer.Identification]
+	if !exists {
+		return info
+	}
+	info.Online = record.online
+	info.LastConnected = record.LastConnected
+	info.LastDisconnected = record.LastDisconnected
+	info.LastSync = record.LastSync
+	info.LastAuthenticated = record.LastAuthenticated
+	info.Latency = record.Latency
+	return info
+}
+
+/*
+markConnected records that the peer at address came online.
+*/
+func (t *Tinzenite) markConnected(address string) {
+	t.updateRecord(address, func(record *peerRecord) {
+		record.online = true
+		record.LastConnected = time.Now()
+	})
+}
+
+/*
+markSynced records a successful model sync with the peer at address.
+*/
+func (t *Tinzenite) markSynced(address string) {
+	t.updateRecord(address, func(record *peerRecord) {
+		record.LastSync = time.Now()
+	})
+}
+
+/*
+markAuthenticated records a successful authentication of the peer at address.
+*/
+func (t *Tinzenite) markAuthenticated(address string) {
+	t.updateRecord(address, func(record *peerRecord) {
+		record.LastAuthenticated = time.Now()
+	})
+}
+
+/*
+checkLiveness looks for peers that went offline, as the channel only tells us
+when peers come online.
+*/
+func (t *Tinzenite) checkLiveness() {
+	for address, peer := range t.peers {
+		if peer.Identification == t.selfpeer.Identification {
+			continue
+		}
+		online, _ := t.channel.IsAddressOnline(address)
+		t.liveness.mutex.Lock()
+		record, exists := t.liveness.Peers[peer.Identification]
+		wasOnline := exists && record.online
+		t.liveness.mutex.Unlock()
+		if wasOnline && !online {
+			t.updateRecord(address, func(record *peerRecord) {
+				record.online = false
+				record.LastDisconnected = time.Now()
+			})
+		} else if !wasOnline && online {
+			// we may have missed the connect, for example on startup
+			t.markConnected(address)
+		}
+	}
+}
+
+/*
+sendPings pings all online peers that understand it.
+*/
+func (t *Tinzenite) sendPings() {
+	message, err := createCoreMessage(corePing, ping{Sent: time.Now()})
+	if err != nil {
+		log.Println("Tinzenite: failed to build ping:", err)
+		return
+	}
+	for address := range t.peers {
+		if !t.supports(address, FeaturePing) {
+			continue
+		}
+		t.channel.Send(address, message)
+	}
+}
+
+/*
+onPing answers a ping or records the round trip time of an answer.
+*/
+func (t *Tinzenite) onPing(address string, msg ping) {
+	if !msg.Pong {
+		msg.Pong = true
+		message, err := createCoreMessage(corePing, msg)
+		if err != nil {
+			log.Println("Tinzenite: failed to build pong:", err)
+			return
+		}
+		t.channel.Send(address, message)
+		return
+	}
+	latency := time.Since(msg.Sent)
+	if latency < 0 {
+		return
+	}
+	t.updateRecord(address, func(record *peerRecord) {
+		record.Latency = latency
+	})
+}
+
+/*
+updateRecord applies the change to the record of the peer at address and stores
+the liveness data.
+*/
+func (t *Tinzenite) updateRecord(address string, change func(*peerRecord)) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	t.liveness.mutex.Lock()
+	defer t.liveness.mutex.Unlock()
+	record, exists := t.liveness.Peers[peer.Identification]
+	if !exists {
+		record = &peerRecord{}
+		t.liveness.Peers[peer.Identification] = record
+	}
+	change(record)
+	err := t.liveness.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store liveness:", err)
+	}
+}
+
+/*
+store writes the liveness data to disk. NOTE: the caller must hold the mutex.
+*/
+func (l *liveness) store() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path, data, shared.FILEPERMISSIONMODE)
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_Liveness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liveness")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadLiveness(dir + "/" + PEERINFOFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{
+		selfpeer: &shared.Peer{Identification: "selfID"},
+		peers: map[string]*shared.Peer{
+			"nasaddress": {Name: "nas", Identification: "nasID", Trusted: true}},
+		liveness: store}
+	tin.markConnected("nasaddress")
+	tin.markSynced("nasaddress")
+	// an answered ping records the latency
+	tin.onPing("nasaddress", ping{Sent: time.Now().Add(-50 * time.Millisecond), Pong: true})
+	info, err := tin.PeerInfo("nasaddress")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	if !info.Online || info.LastConnected.IsZero() || info.LastSync.IsZero() || info.Latency < 50*time.Millisecond {
+		t.Error("Expected liveness to be recorded, got", info)
+	}
+	if _, err := tin.PeerInfo("unknown"); err != errPeerUnknown {
+		t.Error("Expected unknown peer error, got", err)
+	}
+	// must survive a restart, except for the online state
+	tin.liveness, err = loadLiveness(dir + "/" + PEERINFOFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	reloaded, _ := tin.PeerInfo("nasaddress")
+	if reloaded.Online || !reloaded.LastSync.Equal(info.LastSync) || reloaded.Latency != info.Latency {
+		t.Error("Expected liveness to be loaded, got", reloaded)
+	}
+}
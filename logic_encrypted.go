@@ -63,9 +63,25 @@ func (c *chaninterface) onEncLockMessage(address string, msg shared.LockMessage)
 			return
 		}
 		c.tin.peers[address].SetLocked(true)
-		// if LOCKED request model file to begin sync
-		rm := shared.CreateRequestMessage(shared.OtModel, shared.IDMODEL)
-		c.requestFile(address, rm, c.encModelReceived)
+		c.tin.acquiredLease(address)
+		// a running repair drives the sync itself
+		if job := c.tin.repairJob(address); job != nil {
+			job.accepted <- true
+			return
+		}
+		// nothing to sync before the directory exists
+		if c.tin.model == nil {
+			c.tin.releaseLease(address)
+			return
+		}
+		// if LOCKED read the model to begin sync
+		job, err := c.tin.startJob(address)
+		if err != nil {
+			c.warn("Can not sync with encrypted peer:", err.Error())
+			c.tin.releaseLease(address)
+			return
+		}
+		go c.encSync(address, job)
 	case shared.LoRelease:
 		// unset lock of this peer
 		_, exists := c.tin.peers[address]
@@ -73,7 +89,7 @@ func (c *chaninterface) onEncLockMessage(address string, msg shared.LockMessage)
 			c.warn("Can not release peer as peer doesn't exist!")
 			return
 		}
-		c.tin.peers[address].SetLocked(false)
+		c.tin.dropLease(address)
 	default:
 		c.warn("Unknown lock action received:", msg.Action.String())
 	}
@@ -86,7 +102,17 @@ func (c *chaninterface) onEncNotifyMessage(address string, msg shared.NotifyMess
 	switch msg.Notify {
 	case shared.NoMissing:
 		// remove transfer as no file will come
-		delete(c.inTransfers, msg.Identification)
+		c.dropTransfer(transferKey(address, msg.Identification))
+		c.tin.leaseProgress(address)
+		// a running repair is probing for missing objects
+		if job := c.tin.repairJob(address); job != nil {
+			// never block: a job that isn't probing right now doesn't need it
+			select {
+			case job.missing <- msg.Identification:
+			default:
+			}
+			return
+		}
 		// if model --> create it
 		if msg.Identification == shared.IDMODEL {
 			// log that encrypted was empty and that we'll just upload our current state
@@ -95,10 +121,10 @@ func (c *chaninterface) onEncNotifyMessage(address string, msg shared.NotifyMess
 			c.sendCompletePushes(address)
 			return
 		}
-		// TODO: if object --> error... maybe "reset" the encrypted peer?
-		log.Println("DEBUG: object missing!", msg.Identification, msg.Notify)
-		log.Println("DEBUG: TODO: reset encrypted peer?")
-		// TODO implement an enc check method
+		// object is missing --> encrypted peer is inconsistent and must be repaired
+		c.warn("Encrypted peer", address[:8], "is missing object", msg.Identification, ", run RepairEncrypted!")
+		c.tin.forgetUpload(address, msg.Identification)
+		c.tin.checkReplicas()
 	default:
 		c.warn("Unknown notify type received:", msg.Notify.String())
 	}
@@ -110,8 +136,11 @@ message. Triggers the sending of the requested file.
 */
 func (c *chaninterface) onEncRequestMessage(address string, msg shared.RequestMessage) {
 	var path string
-	// if model has been requested --> path is different as not tracked itself
-	if msg.Identification == shared.IDMODEL {
+	// bases, journals and heads are prepared beforehand
+	if journal, exists := c.tin.journalBlob(address, msg.Identification); exists {
+		path = journal
+	} else if msg.Identification == shared.IDMODEL {
+		// if model has been requested --> path is different as not tracked itself
 		path = c.tin.Path + "/" + shared.TINZENITEDIR + "/" + shared.SENDINGDIR + "/" + shared.MODELJSON
 		// get model info
 		model, err := c.tin.model.Read()
@@ -131,6 +160,9 @@ func (c *chaninterface) onEncRequestMessage(address string, msg shared.RequestMe
 			c.warn("Failed to write model info to temp file:", err.Error())
 			return
 		}
+	} else if staged, exists := c.tin.stagedRepair(address, msg.Identification); exists {
+		// object was fetched from another peer for a repair
+		path = staged
 	} else {
 		// get subPath for file
 		subPath, err := c.tin.model.GetSubPath(msg.Identification)
@@ -157,14 +189,16 @@ func (c *chaninterface) encSendFile(address, identification, path string, ot sha
 		c.warn("Failed to read data:", err.Error())
 		return
 	}
-	// encrypt here as long as not auth AND not peer
+	// encrypt here as long as not auth AND not peer, padded to hide the true size
 	if ot != shared.OtAuth && ot != shared.OtPeer {
-		data, err = c.tin.auth.Encrypt(data)
+		data, err = c.tin.auth.Encrypt(c.tin.pad(data))
 		if err != nil {
 			c.warn("Failed to encrypt data!", err.Error())
 			return
 		}
 	}
+	// remember what we send to be able to audit it later
+	hash := hashData(data)
 	// write to temp file
 	sendPath := c.tin.Path + "/" + shared.TINZENITEDIR + "/" + shared.SENDINGDIR + "/" + identification
 	err = ioutil.WriteFile(sendPath, data, shared.FILEPERMISSIONMODE)
@@ -176,12 +210,21 @@ func (c *chaninterface) encSendFile(address, identification, path string, ot sha
 	onComplete := func(status channel.State) {
 		if status != channel.StSuccess {
 			c.log("encSendFile: Failed to upload file!", ot.String(), identification)
+		} else {
+			c.tin.recordUpload(address, identification, hash)
+			if identification == journalHead {
+				c.tin.headUploaded(address)
+			}
 		}
+		// mail is only delivered once uploaded
+		c.tin.mailUploaded(identification, status == channel.StSuccess)
 		// remove sending temp file always
 		err := os.Remove(sendPath)
 		if err != nil {
 			c.warn("Failed to remove sending file!", err.Error())
 		}
+		// release the lease once this was the last upload
+		c.tin.uploaded(address, identification, status == channel.StSuccess)
 	}
 	// send file
 	err = c.tin.channel.SendFile(address, sendPath, identification, onComplete)
@@ -214,50 +257,44 @@ func (c *chaninterface) sendCompletePushes(address string) {
 }
 
 /*
-encModelReceived is called when a model is received from an encrypted peer. It
-triggers the complete sync with the encrypted state, concluding with updating
-the encrypted peer to be up to date with this peer.
+encSync is called once an encrypted peer has been locked. It reads the model of
+the encrypted peer and triggers the complete sync with the encrypted state,
+concluding with updating the encrypted peer to be up to date with this peer.
 */
-func (c *chaninterface) encModelReceived(address, path string) {
-	// no matter what: remove temp file
-	defer func() {
-		err := os.Remove(path)
-		if err != nil {
-			c.warn("encModelReceived: failed to remove received temp model file!", err.Error())
-		}
-	}()
-	// read model
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		c.log("encModelReceived: failed to read received model file:", err.Error())
-		return
+func (c *chaninterface) encSync(address string, job *repairJob) {
+	c.tin.clearPrepared(address)
+	state, err := c.tin.fetchForeign(address, job)
+	if err == nil {
+		// exchange updates between trusted peers while we hold the lock
+		c.tin.collectMail(address, job)
+		c.tin.pruneMail(address, job)
+		c.tin.deliverMail(address, job)
+		// keep what is needed to restore from the encrypted peer alone
+		c.tin.pushRecovery(address)
 	}
-	// decrypt model
-	data, err = c.tin.auth.Decrypt(data)
+	c.tin.endJob(address, job)
 	if err != nil {
-		c.warn("encModelReceived: failed to decrypt model!", err.Error())
+		c.warn("encSync: failed to read model of encrypted peer:", err.Error())
+		c.tin.releaseLease(address)
+		// back off instead of retrying on every tick
+		c.tin.encryptedFailed(address, err.Error())
 		return
 	}
-	// unmarshal
-	foreignModel := &shared.ObjectInfo{}
-	err = json.Unmarshal(data, foreignModel)
-	if err != nil {
-		c.log("encModelReceived: failed to parse JSON:", err.Error())
-		return
+	// the model tells us which objects the encrypted peer holds
+	c.tin.placeObjects(address, state)
+	if state.Empty {
+		// log that encrypted was empty and that we'll just upload our current state
+		c.log("Encrypted is empty, nothing to merge, uploading directly.")
 	}
-	// build path maps and associated object maps of foreign model
+	// build path map of foreign model
 	foreignPaths := make(map[string]bool)
-	foreignObjs := make(map[string]shared.ObjectInfo)
-	foreignModel.ForEach(func(obj shared.ObjectInfo) {
-		foreignPaths[obj.Path] = true
-		// strip of children and write to objects
-		obj.Objects = nil
-		foreignObjs[obj.Path] = obj
-	})
+	for path := range state.Objects {
+		foreignPaths[path] = true
+	}
 	// STEP ONE: get differences that THIS must get and apply from FOREIGN
-	c.encApplyPeer(address, foreignPaths, foreignObjs)
+	c.encApplyPeer(address, foreignPaths, state.Objects)
 	// STEP TWO: get difference that must be UPLOADED to foreign to make it equal to THIS
-	c.encApplyLocal(address, foreignPaths, foreignObjs)
+	c.encApplyLocal(address, foreignPaths, state)
 	// NOTE encrypted will be unlocked once all transfers are complete, see tinzenite.SyncEncrypted
 	log.Println("DEBUG: done encrypted sync, awaiting transfer completion")
 }
@@ -289,7 +326,12 @@ func (c *chaninterface) handleEncryptedMessage(address string, ot shared.ObjectT
 	// apply directories directly
 	if msg.Object.Directory {
 		// no merge because it should never happen for directories
-		return c.tin.model.ApplyUpdateMessage(msg)
+		err = c.tin.model.ApplyUpdateMessage(msg)
+		if err != nil {
+			return err
+		}
+		c.tin.auditRemote(address, *msg)
+		return nil
 	}
 	op := msg.Operation
 	// create and modify must first fetch the file
@@ -323,6 +365,7 @@ func (c *chaninterface) handleEncryptedMessage(address string, ot shared.ObjectT
 					os.Remove(tempLocation)
 					return
 				}
+				data = unpad(data)
 				// write data to file
 				err = ioutil.WriteFile(tempLocation, data, shared.FILEPERMISSIONMODE)
 				if err != nil {
@@ -335,7 +378,9 @@ func (c *chaninterface) handleEncryptedMessage(address string, ot shared.ObjectT
 			err = c.mergeUpdate(*msg)
 			if err != nil {
 				c.log("File application error: " + err.Error())
+				return
 			}
+			c.tin.auditRemote(address, *msg)
 			// done
 		})
 		// wait for file to be received before returning
@@ -344,7 +389,12 @@ func (c *chaninterface) handleEncryptedMessage(address string, ot shared.ObjectT
 		return nil
 	} else if op == shared.OpRemove {
 		// remove is without file transfer, so directly apply
-		return c.mergeUpdate(*msg)
+		err = c.mergeUpdate(*msg)
+		if err != nil {
+			return err
+		}
+		c.tin.auditRemote(address, *msg)
+		return nil
 	}
 	c.warn("Unknown operation received, ignoring update message!")
 	return shared.ErrIllegalParameters
@@ -421,10 +471,11 @@ func (c *chaninterface) encApplyPeer(address string, foreignPaths map[string]boo
 encApplyLocal applies the local peer to the encrypted peer and sends the
 required PushMessages.
 */
-func (c *chaninterface) encApplyLocal(address string, foreignPaths map[string]bool, foreignObjs map[string]shared.ObjectInfo) {
+func (c *chaninterface) encApplyLocal(address string, foreignPaths map[string]bool, state *foreignState) {
+	foreignObjs := state.Objects
 	created, remained, removed := shared.Difference(foreignPaths, c.tin.model.TrackedPaths)
 	// if no differences, we can immediately unlock and release the encryted peer
-	if len(created) == 0 && len(remained) == 0 && len(removed) == 0 {
+	if len(created) == 0 && len(remained) == 0 && len(removed) == 0 && !state.Compact {
 		log.Println("DEBUG: no changes to unlock, releasing immediately")
 		_, exists := c.tin.peers[address]
 		if !exists {
@@ -432,9 +483,8 @@ func (c *chaninterface) encApplyLocal(address string, foreignPaths map[string]bo
 			// just return, may release later or timout
 			return
 		}
-		ulm := shared.CreateLockMessage(shared.LoRelease)
-		c.tin.channel.Send(address, ulm.JSON())
-		c.tin.peers[address].SetLocked(false)
+		// release once mail has been uploaded
+		c.tin.pushedAll(address)
 		// and done so return
 		return
 	}
@@ -491,11 +541,15 @@ func (c *chaninterface) encApplyLocal(address string, foreignPaths map[string]bo
 		ot := c.determineObjectTypeBy(stin.Path)
 		nm := shared.CreateNotifyMessage(shared.NoRemoved, stin.Identification, ot)
 		c.tin.channel.Send(address, nm.JSON())
+		c.tin.orphanUpload(address, stin.Identification)
 	}
 	// and don't forget: update the model too!
-	pm := shared.CreatePushMessage(shared.IDMODEL, shared.OtModel)
-	c.tin.channel.Send(address, pm.JSON())
-	// and done
+	err := c.tin.pushJournal(address, state)
+	if err != nil {
+		c.warn("encApplyLocal: failed to push journal:", err.Error())
+	}
+	// the lease is released once all pushed objects have been uploaded
+	c.tin.pushedAll(address)
 }
 
 /*
@@ -505,5 +559,6 @@ according to the path.
 func (c *chaninterface) encSendPush(address, path, identification string) {
 	ot := c.determineObjectTypeBy(path)
 	pm := shared.CreatePushMessage(identification, ot)
+	c.tin.expectUpload(address, identification)
 	c.tin.channel.Send(address, pm.JSON())
 }
@@ -57,10 +57,9 @@ func (c *chaninterface) onTrustedMessage(address string, msgType shared.MsgType,
 }
 
 func (c *chaninterface) onTrustedRequestMessage(address string, msg shared.RequestMessage) {
-	// this means we need to send our selfpeer (used for bootstrapping)
+	// this means we need to send our selfpeer (only used by external bootstrap
+	// implementations, JoinTinzenite fetches the peer files directly)
 	if msg.ObjType == shared.OtPeer {
-		// TODO check if this is really still in use?
-		log.Println("DEBUG: YES, this is still in use. Why? Bootstrap should have fixed this...")
 		// so build a bogus update message and send that
 		peerPath := shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + shared.PEERSDIR + "/" + c.tin.selfpeer.Identification + shared.ENDING
 		fullPath := shared.CreatePath(c.tin.model.RootPath, peerPath)
@@ -79,6 +78,11 @@ func (c *chaninterface) onTrustedRequestMessage(address string, msg shared.Reque
 		c.log("Failed to locate object for", msg.Identification)
 		return
 	}
+	// never serve what the peer may not receive
+	if !c.tin.canRead(address, obj.Path) {
+		c.warn("Refusing request of", address[:8], "for", obj.Path)
+		return
+	}
 	// make sure we don't try to send a directory
 	if obj.Directory {
 		// theoretically shouldn't happen, but better safe than sorry
@@ -107,6 +111,8 @@ func (c *chaninterface) onTrustedRequestModelMessage(address string, msg shared.
 		c.log("model.Read():", err.Error())
 		return
 	}
+	// only send shadows of paths the peer isn't subscribed to
+	objModel = c.tin.filterModel(address, objModel)
 	// to JSON
 	data, err := json.MarshalIndent(objModel, "", "  ")
 	if err != nil {
@@ -192,6 +198,11 @@ func (c *chaninterface) onTrustedModelFileReceived(address, path string) {
 		log.Println("ReModel failed to parse JSON:", err)
 		return
 	}
+	// never take changes from read-only peers
+	if c.tin.IsReadOnly(address) {
+		c.warn("Ignoring model of read-only peer", address[:8])
+		return
+	}
 	// get difference in updates
 	updateLists, err := c.tin.model.Sync(foreignModel)
 	if err != nil {
@@ -205,6 +216,7 @@ func (c *chaninterface) onTrustedModelFileReceived(address, path string) {
 			c.log("handleMessage failed with:", err.Error())
 		}
 	}
+	c.tin.markSynced(address)
 }
 
 /*
@@ -212,8 +224,37 @@ handleTrustedMessage looks at the message, fetches files if required, and correc
 applies it to the model.
 */
 func (c *chaninterface) handleTrustedMessage(address string, msg *shared.UpdateMessage) error {
+	// read-only peers may not publish changes, whether directly or by mail
+	if c.tin.IsReadOnly(address) {
+		c.warn("Rejecting update from read-only peer", address[:8], "for", msg.Object.Path)
+		return nil
+	}
+	// hold back suspicious mass changes
+	if c.tin.holdIncoming(address, *msg) {
+		return nil
+	}
+	// the ACL decides who may change what
+	if !c.tin.canWrite(address, msg.Object.Path) {
+		c.warn("Rejecting update from", address[:8], "without write access to", msg.Object.Path)
+		return nil
+	}
+	// only admins may change the org directory
+	if !c.tin.checkOrgUpdate(address, msg) {
+		return nil
+	}
+	// only track objects this peer isn't subscribed to
+	if !c.tin.wantsContent(msg) {
+		return c.tin.trackExcluded(address, msg)
+	}
+	// remember the identification the sender knows the object by, as resolving may rename it
+	remoteID := msg.Object.Identification
+	// resolve structural conflicts first as they can not be merged later on
+	msg, err := c.tin.resolveStructural(msg)
+	if err != nil {
+		return err
+	}
 	// use check message to prepare message and check for special cases
-	msg, err := c.tin.model.CheckMessage(msg)
+	msg, err = c.tin.model.CheckMessage(msg)
 	// if update known --> ignore it
 	if err == model.ErrIgnoreUpdate {
 		return nil
@@ -232,16 +273,18 @@ func (c *chaninterface) handleTrustedMessage(address string, msg *shared.UpdateM
 	}
 	// --> IF CheckMessage was ok, we can now handle applying the message
 	// if a transfer was previously in progress, cancel it as we need the newer one
-	_, exists := c.inTransfers[msg.Object.Identification]
+	c.mutex.Lock()
+	other, exists := c.fetchingFrom(remoteID)
+	c.mutex.Unlock()
 	if exists {
-		path := c.recpath + "/" + address + "." + msg.Object.Identification
+		path := c.recpath + "/" + transferKey(other, remoteID)
 		err := c.tin.channel.CancelFileTransfer(path)
 		// if canceling failed throw the error up
 		if err != nil {
 			return err
 		}
 		// remove transfer
-		delete(c.inTransfers, msg.Object.Identification)
+		c.dropTransfer(transferKey(other, remoteID))
 		// remove file if no error
 		_ = os.Remove(path)
 		// done with old one, so continue handling the new update
@@ -249,17 +292,20 @@ func (c *chaninterface) handleTrustedMessage(address string, msg *shared.UpdateM
 	// apply directories directly
 	if msg.Object.Directory {
 		// no merge because it should never happen for directories
-		return c.tin.model.ApplyUpdateMessage(msg)
+		err = c.tin.model.ApplyUpdateMessage(msg)
+		if err != nil {
+			return err
+		}
+		c.tin.auditRemote(address, *msg)
+		return nil
 	}
 	op := msg.Operation
 	// create and modify must first fetch the file
 	if op == shared.OpCreate || op == shared.OpModify {
-		// create & modify must first fetch file
-		rm := shared.CreateRequestMessage(shared.OtObject, msg.Object.Identification)
-		// request file and apply update on success
-		c.requestFile(address, rm, func(address, path string) {
+		// apply update once the file is there
+		apply := func(address, path string) {
 			// rename to correct name for model
-			err := os.Rename(path, c.temppath+"/"+rm.Identification)
+			err := os.Rename(path, c.temppath+"/"+msg.Object.Identification)
 			if err != nil {
 				c.log("Failed to move file to temp: " + err.Error())
 				return
@@ -268,14 +314,31 @@ func (c *chaninterface) handleTrustedMessage(address string, msg *shared.UpdateM
 			err = c.mergeUpdate(*msg)
 			if err != nil {
 				c.log("File application error: " + err.Error())
+				return
 			}
+			c.tin.auditRemote(address, *msg)
 			// done
-		})
+		}
+		// content delivered through a mailbox doesn't have to be fetched
+		mailed := c.mailPath(address, remoteID)
+		if _, err := os.Stat(mailed); err == nil {
+			apply(address, mailed)
+			return nil
+		}
+		// create & modify must first fetch file (by the identification the sender knows)
+		rm := shared.CreateRequestMessage(shared.OtObject, remoteID)
+		// request file and apply update on success
+		c.requestFile(address, rm, apply)
 		// errors may turn up but only when the file has been received, so done here
 		return nil
 	} else if op == shared.OpRemove {
 		// remove is without file transfer, so directly apply
-		return c.mergeUpdate(*msg)
+		err = c.mergeUpdate(*msg)
+		if err != nil {
+			return err
+		}
+		c.tin.auditRemote(address, *msg)
+		return nil
 	}
 	c.warn("Unknown operation received, ignoring update message!")
 	return shared.ErrIllegalParameters
@@ -0,0 +1,511 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Trusted peers that are offline receive updates through encrypted peers: the
+sender drops a batch per recipient into the mailbox of the recipient on the
+encrypted peer, the recipient applies and removes it on its next sync with that
+encrypted peer. The mailbox of a peer is an index listing its batches.
+*/
+const mailboxPrefix = "mailbox."
+
+/*
+mailboxMaxFile is the largest file sent through a mailbox. Larger files wait for
+a direct sync.
+*/
+const mailboxMaxFile = 8 * 1024 * 1024
+
+/*
+mailboxMaxBatch is the most content put into a single batch. More is split into
+several batches.
+*/
+const mailboxMaxBatch = 32 * 1024 * 1024
+
+/*
+mailboxMaxQueue is the most updates queued for a single peer. Beyond that the
+queue is dropped, as a full sync is cheaper.
+*/
+const mailboxMaxQueue = 10000
+
+/*
+mailIndex lists the batches in the mailbox of a peer.
+*/
+type mailIndex struct {
+	Batches []string
+}
+
+/*
+mailBatch holds updates of one sender for one recipient, together with the
+content of created and modified files. NOTE: the sender is not authenticated
+beyond the network key: a removed peer that kept the key can pose as any other
+peer until the key is changed.
+*/
+type mailBatch struct {
+	Sender  string // identification of the sending peer
+	Updates []mailUpdate
+}
+
+type mailUpdate struct {
+	Message shared.UpdateMessage
+	Content []byte
+}
+
+/*
+outbox stores the updates for offline trusted peers until they have been
+dropped into a mailbox. Queued is keyed by the identification of the recipient,
+Sending by the identification of the batch.
+*/
+type outbox struct {
+	mutex   sync.Mutex
+	path    string
+	Queued  map[string][]shared.UpdateMessage
+	Sending map[string]*mailDelivery
+}
+
+/*
+mailDelivery is a batch that is being uploaded. Its updates are queued again
+unless both the batch and the index of the recipient are uploaded.
+*/
+type mailDelivery struct {
+	Recipient string
+	Updates   []shared.UpdateMessage
+	Pending   map[string]bool // identifications of blobs not yet uploaded
+}
+
+func loadOutbox(path string) (*outbox, error) {
+	o := &outbox{
+		path:    path,
+		Queued:  make(map[string][]shared.UpdateMessage),
+		Sending: make(map[string]*mailDelivery)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return o, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.Queued == nil {
+		o.Queued = make(map[string][]shared.UpdateMessage)
+	}
+	if o.Sending == nil {
+		o.Sending = make(map[string]*mailDelivery)
+	}
+	return o, nil
+}
+
+/*
+queueMail keeps an update for the offline trusted peer at address if there is
+an encrypted peer to deliver it through.
+*/
+func (t *Tinzenite) queueMail(address string, msg shared.UpdateMessage) {
+	if !t.hasEncrypted() {
+		return
+	}
+	peer := t.peers[address]
+	t.outbox.mutex.Lock()
+	defer t.outbox.mutex.Unlock()
+	queue := append(t.outbox.Queued[peer.Identification], msg)
+	if len(queue) > mailboxMaxQueue {
+		log.Println("Tinzenite: too many updates for", peer.Name, ", waiting for a direct sync.")
+		queue = nil
+	}
+	t.outbox.Queued[peer.Identification] = queue
+	err := t.outbox.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store outbox:", err)
+	}
+}
+
+/*
+deliverMail drops the queued updates into the mailboxes on the encrypted peer at
+address. They stay in the outbox until their upload is confirmed. NOTE: the peer
+must be locked and job must be registered for it.
+*/
+func (t *Tinzenite) deliverMail(address string, job *repairJob) {
+	t.outbox.mutex.Lock()
+	// deliveries of earlier syncs that were never confirmed are sent again
+	for id, delivery := range t.outbox.Sending {
+		t.outbox.Queued[delivery.Recipient] = append(delivery.Updates, t.outbox.Queued[delivery.Recipient]...)
+		delete(t.outbox.Sending, id)
+	}
+	queued := t.outbox.Queued
+	t.outbox.Queued = make(map[string][]shared.UpdateMessage)
+	t.outbox.mutex.Unlock()
+	var failed []string
+	for recipient, msgs := range queued {
+		err := t.deliverBatches(address, job, recipient, msgs)
+		if err != nil {
+			log.Println("Tinzenite: failed to deliver mail:", err)
+			failed = append(failed, recipient)
+		}
+	}
+	// keep what couldn't be delivered for the next sync
+	t.outbox.mutex.Lock()
+	for _, recipient := range failed {
+		t.outbox.Queued[recipient] = append(queued[recipient], t.outbox.Queued[recipient]...)
+	}
+	err := t.outbox.store()
+	t.outbox.mutex.Unlock()
+	if err != nil {
+		log.Println("Tinzenite: failed to store outbox:", err)
+	}
+}
+
+/*
+deliverBatches adds the messages to the mailbox of the recipient, split into
+batches of at most mailboxMaxBatch content.
+*/
+func (t *Tinzenite) deliverBatches(address string, job *repairJob, recipient string, msgs []shared.UpdateMessage) error {
+	index, err := t.fetchMailIndex(address, job, recipient)
+	if err != nil {
+		return err
+	}
+	indexID := mailboxIndexID(recipient)
+	deliveries := make(map[string]*mailDelivery)
+	batch := mailBatch{Sender: t.selfpeer.Identification}
+	var updates []shared.UpdateMessage
+	size := 0
+	flush := func() error {
+		if len(batch.Updates) == 0 {
+			return nil
+		}
+		id := mailboxPrefix + recipient + "." + t.selfpeer.Identification + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+		err := t.prepareBlob(address, id, batch)
+		if err != nil {
+			return err
+		}
+		index.Batches = append(index.Batches, id)
+		deliveries[id] = &mailDelivery{
+			Recipient: recipient,
+			Updates:   updates,
+			Pending:   map[string]bool{id: true, indexID: true}}
+		batch = mailBatch{Sender: t.selfpeer.Identification}
+		updates = nil
+		size = 0
+		return nil
+	}
+	for _, msg := range latestPerObject(msgs) {
+		update, ok := t.mailUpdate(msg)
+		if !ok {
+			continue
+		}
+		if size > 0 && size+len(update.Content) > mailboxMaxBatch {
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+		batch.Updates = append(batch.Updates, update)
+		updates = append(updates, msg)
+		size += len(update.Content)
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	err = t.prepareBlob(address, indexID, index)
+	if err != nil {
+		return err
+	}
+	t.outbox.mutex.Lock()
+	for id, delivery := range deliveries {
+		t.outbox.Sending[id] = delivery
+	}
+	t.outbox.mutex.Unlock()
+	for id := range deliveries {
+		t.pushMail(address, id)
+	}
+	t.pushMail(address, indexID)
+	return nil
+}
+
+/*
+mailUpdate returns the update to mail for the message with the current state
+of its object. Returns false if there is nothing to mail.
+*/
+func (t *Tinzenite) mailUpdate(msg shared.UpdateMessage) (mailUpdate, bool) {
+	update := mailUpdate{Message: msg}
+	if msg.Object.Directory || msg.Operation == shared.OpRemove {
+		return update, true
+	}
+	// send the current state, later changes are included anyway
+	current, err := t.model.GetInfo(shared.CreatePath(t.Path, msg.Object.Path))
+	if err != nil {
+		// removed meanwhile, the removal follows
+		return update, false
+	}
+	update.Message.Object = *current
+	update.Message.Object.Objects = nil
+	if msg.Object.Shadow {
+		return update, true
+	}
+	stat, err := os.Stat(t.Path + "/" + msg.Object.Path)
+	if err != nil || stat.Size() > mailboxMaxFile {
+		return update, false
+	}
+	update.Content, err = ioutil.ReadFile(t.Path + "/" + msg.Object.Path)
+	if err != nil {
+		return update, false
+	}
+	return update, true
+}
+
+func (t *Tinzenite) pushMail(address, identification string) {
+	pm := shared.CreatePushMessage(identification, shared.OtObject)
+	t.expectUpload(address, identification)
+	t.channel.Send(address, pm.JSON())
+}
+
+/*
+mailUploaded is called once the upload of a mailbox blob has completed. Failed
+deliveries are queued again.
+*/
+func (t *Tinzenite) mailUploaded(identification string, success bool) {
+	if !isMailboxID(identification) {
+		return
+	}
+	t.outbox.mutex.Lock()
+	defer t.outbox.mutex.Unlock()
+	for id, delivery := range t.outbox.Sending {
+		if !delivery.Pending[identification] {
+			continue
+		}
+		if !success {
+			t.outbox.Queued[delivery.Recipient] = append(delivery.Updates, t.outbox.Queued[delivery.Recipient]...)
+			delete(t.outbox.Sending, id)
+			continue
+		}
+		delete(delivery.Pending, identification)
+		if len(delivery.Pending) == 0 {
+			delete(t.outbox.Sending, id)
+		}
+	}
+	err := t.outbox.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store outbox:", err)
+	}
+}
+
+/*
+collectMail applies the batches in our mailbox on the encrypted peer at address
+and removes them. NOTE: the peer must be locked and job must be registered for
+it.
+*/
+func (t *Tinzenite) collectMail(address string, job *repairJob) {
+	index, err := t.fetchMailIndex(address, job, t.selfpeer.Identification)
+	if err != nil {
+		log.Println("Tinzenite: failed to read mailbox:", err)
+		return
+	}
+	if len(index.Batches) == 0 {
+		return
+	}
+	for _, id := range index.Batches {
+		data, missing, err := t.fetchBlob(address, job, id, shared.OtObject)
+		if err != nil {
+			// leave the mailbox as it is to try again
+			log.Println("Tinzenite: failed to fetch mail:", err)
+			return
+		}
+		if !missing {
+			batch := mailBatch{}
+			err = json.Unmarshal(data, &batch)
+			if err != nil {
+				log.Println("Tinzenite: ignoring invalid mail:", err)
+			} else {
+				t.applyMail(batch)
+			}
+		}
+		// acknowledge by removing it
+		nm := shared.CreateNotifyMessage(shared.NoRemoved, id, shared.OtObject)
+		t.channel.Send(address, nm.JSON())
+		t.forgetUpload(address, id)
+	}
+	nm := shared.CreateNotifyMessage(shared.NoRemoved, mailboxIndexID(t.selfpeer.Identification), shared.OtObject)
+	t.channel.Send(address, nm.JSON())
+	t.forgetUpload(address, mailboxIndexID(t.selfpeer.Identification))
+}
+
+/*
+pruneMail drops the mailbox blobs we uploaded to the encrypted peer at address
+from the manifest once their recipient has collected them, which the recipient
+does by removing them from its index. NOTE: the peer must be locked and job must
+be registered for it.
+*/
+func (t *Tinzenite) pruneMail(address string, job *repairJob) {
+	peer := t.peers[address]
+	uploaded := make(map[string][]string) // by recipient
+	t.manifest.mutex.Lock()
+	for id := range t.manifest.Peers[peer.Identification] {
+		if isMailboxID(id) {
+			recipient := mailboxRecipient(id)
+			uploaded[recipient] = append(uploaded[recipient], id)
+		}
+	}
+	t.manifest.mutex.Unlock()
+	for recipient, ids := range uploaded {
+		index, err := t.fetchMailIndex(address, job, recipient)
+		if err != nil {
+			log.Println("Tinzenite: failed to read mailbox:", err)
+			continue
+		}
+		listed := make(map[string]bool)
+		for _, id := range index.Batches {
+			listed[id] = true
+		}
+		for _, id := range ids {
+			// an emptied mailbox has its index removed too
+			if id == mailboxIndexID(recipient) && len(index.Batches) > 0 {
+				continue
+			}
+			if !listed[id] {
+				t.forgetUpload(address, id)
+			}
+		}
+	}
+}
+
+/*
+applyMail applies the updates of a batch as if they had been received from the
+sender directly. NOTE: as the sender is not authenticated, see mailBatch, the
+check against removed peers only holds once the network key has been changed.
+*/
+func (t *Tinzenite) applyMail(batch mailBatch) {
+	sender, exists := t.addressOf(batch.Sender)
+	if !exists || !t.peers[sender].Trusted || t.isRevoked(sender) {
+		log.Println("Tinzenite: ignoring mail from unknown or untrusted peer.")
+		return
+	}
+	for _, update := range batch.Updates {
+		msg := update.Message
+		path := t.cInterface.mailPath(sender, msg.Object.Identification)
+		if update.Content != nil {
+			err := ioutil.WriteFile(path, update.Content, shared.FILEPERMISSIONMODE)
+			if err != nil {
+				log.Println("Tinzenite: failed to write mail content:", err)
+				continue
+			}
+		}
+		err := t.cInterface.handleTrustedMessage(sender, &msg)
+		if err != nil {
+			log.Println("Tinzenite: failed to apply mail:", err)
+		}
+		// ignored updates leave their content behind
+		os.Remove(path)
+	}
+}
+
+/*
+fetchMailIndex reads the mailbox index of the recipient, which is empty if it
+doesn't exist.
+*/
+func (t *Tinzenite) fetchMailIndex(address string, job *repairJob, recipient string) (*mailIndex, error) {
+	index := &mailIndex{}
+	data, missing, err := t.fetchBlob(address, job, mailboxIndexID(recipient), shared.OtObject)
+	if err != nil || missing {
+		return index, err
+	}
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+/*
+hasEncrypted returns true if the network has at least one encrypted peer.
+*/
+func (t *Tinzenite) hasEncrypted() bool {
+	for _, peer := range t.peers {
+		if !peer.Trusted {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+addressOf returns the address of the peer with the identification.
+*/
+func (t *Tinzenite) addressOf(identification string) (string, bool) {
+	for address, peer := range t.peers {
+		if peer.Identification == identification {
+			return address, true
+		}
+	}
+	return "", false
+}
+
+/*
+mailPath is where the content of a mailed update is placed so that it is used
+instead of requesting it from the sender.
+*/
+func (c *chaninterface) mailPath(address, identification string) string {
+	return c.temppath + "/" + address + ".mail." + identification
+}
+
+/*
+store writes the outbox to disk. NOTE: the caller must hold the mutex.
+*/
+func (o *outbox) store() error {
+	data, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(o.path, data, shared.FILEPERMISSIONMODE)
+}
+
+/*
+latestPerObject keeps only the last update of every object, in order.
+*/
+func latestPerObject(msgs []shared.UpdateMessage) []shared.UpdateMessage {
+	last := make(map[string]int)
+	for i, msg := range msgs {
+		last[msg.Object.Identification] = i
+	}
+	var list []shared.UpdateMessage
+	for i, msg := range msgs {
+		if last[msg.Object.Identification] == i {
+			list = append(list, msg)
+		}
+	}
+	return list
+}
+
+/*
+isMailboxID returns true for the identifications of mailbox indices and batches.
+*/
+func isMailboxID(identification string) bool {
+	return strings.HasPrefix(identification, mailboxPrefix)
+}
+
+/*
+mailboxRecipient returns the identification of the peer a mailbox index or batch
+belongs to.
+*/
+func mailboxRecipient(identification string) string {
+	return strings.SplitN(strings.TrimPrefix(identification, mailboxPrefix), ".", 2)[0]
+}
+
+func mailboxIndexID(recipient string) string {
+	return mailboxPrefix + recipient
+}
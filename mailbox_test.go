@@ -0,0 +1,91 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_MailboxIDs(t *testing.T) {
+	if mailboxRecipient(mailboxIndexID("recipient")) != "recipient" {
+		t.Error("Expected recipient of index")
+	}
+	if mailboxRecipient(mailboxPrefix+"recipient.sender.123") != "recipient" {
+		t.Error("Expected recipient of batch")
+	}
+	if !isMailboxID(mailboxIndexID("recipient")) || isMailboxID(journalHead) {
+		t.Error("Expected only mailbox ids to be recognized")
+	}
+}
+
+func Test_LatestPerObject(t *testing.T) {
+	msgs := []shared.UpdateMessage{
+		shared.UpdateMessage{Operation: shared.OpCreate, Object: shared.ObjectInfo{Identification: "one"}},
+		shared.UpdateMessage{Operation: shared.OpCreate, Object: shared.ObjectInfo{Identification: "two"}},
+		shared.UpdateMessage{Operation: shared.OpModify, Object: shared.ObjectInfo{Identification: "one"}}}
+	latest := latestPerObject(msgs)
+	if len(latest) != 2 || latest[0].Object.Identification != "two" || latest[1].Operation != shared.OpModify {
+		t.Error("Expected last update of every object in order, got", latest)
+	}
+}
+
+func Test_OutboxQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadOutbox(dir + "/" + OUTBOXFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{
+		peers: map[string]*shared.Peer{
+			"trustedpeer": &shared.Peer{Address: "trustedpeer", Identification: "trusted", Trusted: true}},
+		outbox: store}
+	msg := shared.UpdateMessage{Operation: shared.OpCreate, Object: shared.ObjectInfo{Identification: "one"}}
+	tin.queueMail("trustedpeer", msg)
+	if len(store.Queued["trusted"]) != 0 {
+		t.Error("Expected nothing to be queued without an encrypted peer")
+	}
+	tin.peers["encryptedpeer"] = &shared.Peer{Address: "encryptedpeer", Identification: "encrypted"}
+	tin.queueMail("trustedpeer", msg)
+	store, err = loadOutbox(dir + "/" + OUTBOXFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	if len(store.Queued["trusted"]) != 1 {
+		t.Error("Expected queued update to be stored, got", store.Queued)
+	}
+}
+
+func Test_MailUploaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadOutbox(dir + "/" + OUTBOXFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{outbox: store}
+	msg := shared.UpdateMessage{Operation: shared.OpCreate, Object: shared.ObjectInfo{Identification: "one"}}
+	for _, id := range []string{"mailbox.trusted.a.1", "mailbox.trusted.a.2"} {
+		store.Sending[id] = &mailDelivery{
+			Recipient: "trusted",
+			Updates:   []shared.UpdateMessage{msg},
+			Pending:   map[string]bool{id: true, mailboxIndexID("trusted"): true}}
+	}
+	tin.mailUploaded("mailbox.trusted.a.1", true)
+	tin.mailUploaded(mailboxIndexID("trusted"), true)
+	if _, exists := store.Sending["mailbox.trusted.a.1"]; exists {
+		t.Error("Expected confirmed delivery to be done")
+	}
+	tin.mailUploaded("mailbox.trusted.a.2", false)
+	if len(store.Sending) != 0 || len(store.Queued["trusted"]) != 1 {
+		t.Error("Expected failed delivery to be queued again, got", store.Queued)
+	}
+}
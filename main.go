@@ -1,6 +1,8 @@
 package core
 
 import (
+	"log"
+
 	"github.com/tinzenite/channel"
 	"github.com/tinzenite/model"
 	"github.com/tinzenite/shared"
@@ -37,6 +39,12 @@ func CreateTinzenite(dirname, dirpath, peername, username, password string) (*Ti
 	tinzenite := &Tinzenite{
 		Path: dirpath,
 		auth: auth}
+	// load local stores before any callback can use them
+	err = tinzenite.loadStores()
+	if err != nil {
+		failed = true
+		return nil, err
+	}
 	// prepare chaninterface
 	tinzenite.cInterface = createChannelInterface(tinzenite)
 	// build channel
@@ -82,7 +90,11 @@ func CreateTinzenite(dirname, dirpath, peername, username, password string) (*Ti
 		failed = true
 		return nil, err
 	}
-	tinzenite.initialize()
+	err = tinzenite.initialize()
+	if err != nil {
+		failed = true
+		return nil, err
+	}
 	return tinzenite, nil
 }
 
@@ -119,6 +131,11 @@ func LoadTinzenite(dirpath, password string) (*Tinzenite, error) {
 		return nil, err
 	}
 	t.selfpeer = selfToxDump.SelfPeer
+	// load local stores before any callback can use them
+	err = t.loadStores()
+	if err != nil {
+		return nil, err
+	}
 	// prepare chaninterface
 	t.cInterface = createChannelInterface(t)
 	// prepare channel
@@ -127,8 +144,126 @@ func LoadTinzenite(dirpath, password string) (*Tinzenite, error) {
 		return nil, err
 	}
 	t.channel = channel
-	t.initialize()
+	err = t.initialize()
+	if err != nil {
+		return nil, err
+	}
 	// empty temp folder to remove orphaned files (ignore error because we don't care if it works)
 	_ = shared.RemoveDirContents(t.Path + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR)
 	return t, nil
 }
+
+/*
+JoinTinzenite makes a directory a Tinzenite directory by joining the existing
+network of the peer at remoteAddress. Blocks until the remote peer has accepted
+the request and the network data has been fetched, so it can take long. The
+password must be the one of the network.
+*/
+func JoinTinzenite(dirpath, peername, remoteAddress, password string) (*Tinzenite, error) {
+	return joinTinzenite(dirpath, peername, remoteAddress, "", password)
+}
+
+/*
+JoinTinzeniteWithInvite works like JoinTinzenite but presents an invitation
+token, so that the request is accepted without asking the remote user.
+*/
+func JoinTinzeniteWithInvite(dirpath, peername, token, password string) (*Tinzenite, error) {
+	invite, err := ParseInvite(token)
+	if err != nil {
+		return nil, err
+	}
+	return joinTinzenite(dirpath, peername, invite.Address, token, password)
+}
+
+func joinTinzenite(dirpath, peername, remoteAddress, token, password string) (*Tinzenite, error) {
+	if shared.IsTinzenite(dirpath) {
+		return nil, shared.ErrIsTinzenite
+	}
+	// flag whether we have to clean up after us
+	var failed bool
+	// make .tinzenite
+	err := shared.MakeTinzeniteDir(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	// if failed was set --> clean up by removing everything
+	defer func() {
+		if failed {
+			shared.RemoveDotTinzenite(dirpath)
+		}
+	}()
+	// Build
+	tinzenite := &Tinzenite{Path: dirpath}
+	// load local stores before any callback can use them
+	err = tinzenite.loadStores()
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	// prepare chaninterface
+	tinzenite.cInterface = createChannelInterface(tinzenite)
+	// build channel
+	channel, err := channel.Create(peername, nil, tinzenite.cInterface)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	tinzenite.channel = channel
+	// close channel if we fail from here on
+	defer func() {
+		if failed {
+			channel.Close()
+		}
+	}()
+	// build self peer
+	address, err := channel.Address()
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	peer, err := shared.CreatePeer(peername, address, true)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	tinzenite.selfpeer = peer
+	tinzenite.peers = make(map[string]*shared.Peer)
+	tinzenite.peers[peer.Address] = peer
+	// fetch auth and peers from the network (blocks until accepted!)
+	err = tinzenite.joinNetwork(remoteAddress, token, password)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	// build model (can block for long!)
+	m, err := model.Create(dirpath, peer.Identification, dirpath+"/"+shared.STOREMODELDIR)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	tinzenite.model = m
+	// store initial copy, this also distributes our own peer file
+	err = tinzenite.Store()
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	// save that this directory is now a tinzenite dir
+	err = shared.WriteDirectoryList(tinzenite.Path)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	err = tinzenite.initialize()
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	// fetch the content of the network
+	err = tinzenite.SyncRemote()
+	if err != nil {
+		// not fatal: the next sync will catch up
+		log.Println("Tinzenite: initial sync failed:", err)
+	}
+	return tinzenite, nil
+}
@@ -0,0 +1,120 @@
+package core
+
+import "encoding/json"
+
+/*
+coreMessage is the envelope of messages that only core understands. They are
+told apart from the messages of the shared library by the Core field, which is
+never set for those.
+*/
+type coreMessage struct {
+	Core string          // kind of the message
+	Data json.RawMessage // content depending on the kind
+}
+
+/*
+Kinds of core messages.
+*/
+const (
+	coreApprove = "approve"
+	coreHello   = "hello"
+	corePing    = "ping"
+	coreLease   = "lease"
+	coreListing = "listing"
+)
+
+/*
+createCoreMessage builds the JSON of a core message of the given kind.
+*/
+func createCoreMessage(kind string, data interface{}) (string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	msg, err := json.Marshal(coreMessage{Core: kind, Data: raw})
+	if err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+/*
+parseCoreMessage returns the core message if message is one.
+*/
+func parseCoreMessage(message string) (*coreMessage, bool) {
+	msg := &coreMessage{}
+	err := json.Unmarshal([]byte(message), msg)
+	if err != nil || msg.Core == "" {
+		return nil, false
+	}
+	return msg, true
+}
+
+/*
+onCoreMessage handles messages specific to core. Hellos and pings are accepted
+from all known peers, listings only from encrypted peers, everything else only
+from authenticated trusted peers.
+*/
+func (c *chaninterface) onCoreMessage(address string, msg *coreMessage) {
+	if _, known := c.tin.peers[address]; !known {
+		c.log("Ignoring core message from unknown peer", address[:8])
+		return
+	}
+	if msg.Core == coreHello {
+		received := hello{}
+		err := json.Unmarshal(msg.Data, &received)
+		if err != nil {
+			c.warn("Invalid hello:", err.Error())
+			return
+		}
+		c.tin.onHello(address, received)
+		return
+	}
+	if msg.Core == corePing {
+		received := ping{}
+		err := json.Unmarshal(msg.Data, &received)
+		if err != nil {
+			c.warn("Invalid ping:", err.Error())
+			return
+		}
+		c.tin.onPing(address, received)
+		return
+	}
+	if msg.Core == coreListing {
+		// only encrypted peers hold objects for us
+		if c.tin.peers[address].Trusted {
+			c.log("Ignoring listing from trusted peer", address[:8])
+			return
+		}
+		received := listing{}
+		err := json.Unmarshal(msg.Data, &received)
+		if err != nil {
+			c.warn("Invalid listing:", err.Error())
+			return
+		}
+		c.tin.onListing(address, received)
+		return
+	}
+	trusted, err := c.tin.isPeerTrusted(address)
+	if err != nil || !trusted {
+		c.log("Ignoring core message from untrusted peer", address[:8])
+		return
+	}
+	// org changes can only be handled once joined
+	if c.tin.model == nil {
+		c.log("Ignoring core message while joining.")
+		return
+	}
+	switch msg.Core {
+	case coreApprove:
+		approval := orgApproval{}
+		err := json.Unmarshal(msg.Data, &approval)
+		if err != nil {
+			c.warn("Invalid approval:", err.Error())
+			return
+		}
+		c.tin.onApproval(address, approval.ID)
+	default:
+		c.warn("Unknown core message received:", msg.Core)
+	}
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+/*
+Padding modes for objects uploaded to encrypted peers.
+*/
+const (
+	PadNone       = iota // upload objects with the header only
+	PadPowerOfTwo        // pad to the next power of two
+	PadBlock             // pad to a multiple of the block size
+)
+
+/*
+paddingMinimum is the smallest size padded objects are rounded up to, so that
+small files and journals all look alike.
+*/
+const paddingMinimum = 1024
+
+/*
+paddingBlock is the block size used if the policy doesn't set one.
+*/
+const paddingBlock = 64 * 1024
+
+/*
+paddingMagic marks padded plaintext. It is followed by the true length, the data
+and the padding, all of which is encrypted. It is written for every policy,
+including PadNone, so that data which happens to start with it is never
+mistaken for padding. Only objects uploaded by peers without padding support
+lack it and are read as they are.
+*/
+var paddingMagic = []byte("tinzenite-padded")
+
+/*
+PaddingPolicy configures how objects uploaded to encrypted peers are padded to
+hide their true size.
+*/
+type PaddingPolicy struct {
+	Mode  int // one of PadNone, PadPowerOfTwo or PadBlock
+	Block int // block size for PadBlock in bytes
+}
+
+var defaultPaddingPolicy = PaddingPolicy{Mode: PadPowerOfTwo}
+
+/*
+padding holds the padding policy.
+*/
+type padding struct {
+	mutex  sync.Mutex
+	policy PaddingPolicy
+}
+
+func createPadding() *padding {
+	return &padding{policy: defaultPaddingPolicy}
+}
+
+/*
+SetPaddingPolicy sets how objects uploaded to encrypted peers are padded. Only
+affects future uploads.
+*/
+func (t *Tinzenite) SetPaddingPolicy(policy PaddingPolicy) {
+	t.padding.mutex.Lock()
+	defer t.padding.mutex.Unlock()
+	t.padding.policy = policy
+}
+
+/*
+pad returns the data padded according to the policy, ready to be encrypted.
+*/
+func (t *Tinzenite) pad(data []byte) []byte {
+	t.padding.mutex.Lock()
+	policy := t.padding.policy
+	t.padding.mutex.Unlock()
+	return padData(data, policy)
+}
+
+func padData(data []byte, policy PaddingPolicy) []byte {
+	length := len(paddingMagic) + 8 + len(data)
+	size := paddingMinimum
+	switch policy.Mode {
+	case PadNone:
+		size = length
+	case PadBlock:
+		block := policy.Block
+		if block <= 0 {
+			block = paddingBlock
+		}
+		size = ((length + block - 1) / block) * block
+	default:
+		for size < length {
+			size *= 2
+		}
+	}
+	padded := make([]byte, size)
+	copy(padded, paddingMagic)
+	binary.BigEndian.PutUint64(padded[len(paddingMagic):], uint64(len(data)))
+	copy(padded[len(paddingMagic)+8:], data)
+	return padded
+}
+
+/*
+unpad returns the true data of decrypted plaintext. Plaintext without the header
+was uploaded without padding support and is returned as it is.
+*/
+func unpad(data []byte) []byte {
+	header := len(paddingMagic) + 8
+	if len(data) < header || !bytes.Equal(data[:len(paddingMagic)], paddingMagic) {
+		return data
+	}
+	length := binary.BigEndian.Uint64(data[len(paddingMagic):header])
+	if length > uint64(len(data)-header) {
+		return data
+	}
+	return data[header : header+int(length)]
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Padding(t *testing.T) {
+	data := []byte("some content")
+	padded := padData(data, PaddingPolicy{Mode: PadPowerOfTwo})
+	if len(padded) != paddingMinimum {
+		t.Error("Expected padding to minimum size, got", len(padded))
+	}
+	if !bytes.Equal(unpad(padded), data) {
+		t.Error("Expected padding to be stripped")
+	}
+	large := make([]byte, 3000)
+	if size := len(padData(large, PaddingPolicy{Mode: PadPowerOfTwo})); size != 4096 {
+		t.Error("Expected next power of two, got", size)
+	}
+	if size := len(padData(large, PaddingPolicy{Mode: PadBlock, Block: 1000})); size != 4000 {
+		t.Error("Expected multiple of block size, got", size)
+	}
+	unpadded := padData(data, PaddingPolicy{Mode: PadNone})
+	if len(unpadded) != len(paddingMagic)+8+len(data) || !bytes.Equal(unpad(unpadded), data) {
+		t.Error("Expected only the header without padding")
+	}
+	// data that starts with the magic is not mistaken for padding
+	tricky := append(append([]byte{}, paddingMagic...), make([]byte, 16)...)
+	if !bytes.Equal(unpad(padData(tricky, PaddingPolicy{Mode: PadNone})), tricky) {
+		t.Error("Expected data starting with the magic to survive")
+	}
+	// objects uploaded before padding are read as they are
+	if !bytes.Equal(unpad(data), data) {
+		t.Error("Expected unpadded data to be unchanged")
+	}
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+PendingPeer is a friend request that has not yet been allowed or denied.
+*/
+type PendingPeer struct {
+	Address  string       // address the request came from
+	Name     string       // name the peer gave itself
+	Trusted  bool         // whether the peer requests to be trusted
+	Received time.Time    // time the request was received
+	Expires  time.Time    // time after which the request is dropped
+	Peer     *shared.Peer // the peer as sent with the request
+}
+
+/*
+pending is the persistent store of friend requests and of denied addresses.
+*/
+type pending struct {
+	mutex    sync.Mutex
+	path     string
+	Requests map[string]*PendingPeer // pending requests by address
+	Denied   map[string]time.Time    // denied addresses with time of denial
+}
+
+/*
+loadPending loads the store from the given file, creating an empty one if it
+doesn't exist yet.
+*/
+func loadPending(path string) (*pending, error) {
+	p := &pending{
+		path:     path,
+		Requests: make(map[string]*PendingPeer),
+		Denied:   make(map[string]time.Time)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+	// json may leave these nil if they were empty
+	if p.Requests == nil {
+		p.Requests = make(map[string]*PendingPeer)
+	}
+	if p.Denied == nil {
+		p.Denied = make(map[string]time.Time)
+	}
+	return p, nil
+}
+
+/*
+PendingPeers returns all friend requests awaiting a decision.
+*/
+func (t *Tinzenite) PendingPeers() []PendingPeer {
+	t.pending.mutex.Lock()
+	defer t.pending.mutex.Unlock()
+	t.pending.expire()
+	var list []PendingPeer
+	for _, request := range t.pending.Requests {
+		list = append(list, *request)
+	}
+	return list
+}
+
+/*
+DenyPeer refuses the friend request of the address. Further requests from the
+address are ignored.
+*/
+func (t *Tinzenite) DenyPeer(address string) error {
+	t.pending.mutex.Lock()
+	defer t.pending.mutex.Unlock()
+	t.pending.expire()
+	if _, exists := t.pending.Requests[address]; !exists {
+		return errPeerRequestUnknown
+	}
+	delete(t.pending.Requests, address)
+	t.pending.Denied[address] = time.Now()
+	return t.pending.store()
+}
+
+/*
+add a friend request. Returns true if the request is new.
+*/
+func (p *pending) add(address string, peer *shared.Peer) (bool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expire()
+	_, exists := p.Requests[address]
+	now := time.Now()
+	p.Requests[address] = &PendingPeer{
+		Address:  address,
+		Name:     peer.Name,
+		Trusted:  peer.Trusted,
+		Received: now,
+		Expires:  now.Add(pendingTimeout),
+		Peer:     peer}
+	return !exists, p.store()
+}
+
+/*
+take removes the friend request of the address and returns the peer it was for.
+*/
+func (p *pending) take(address string) (*shared.Peer, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expire()
+	request, exists := p.Requests[address]
+	if !exists {
+		return nil, errPeerRequestUnknown
+	}
+	delete(p.Requests, address)
+	return request.Peer, p.store()
+}
+
+/*
+remove the friend request of the address if one exists.
+*/
+func (p *pending) remove(address string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, exists := p.Requests[address]; !exists {
+		return nil
+	}
+	delete(p.Requests, address)
+	return p.store()
+}
+
+/*
+isDenied returns true if the address has been denied before.
+*/
+func (p *pending) isDenied(address string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, denied := p.Denied[address]
+	return denied
+}
+
+/*
+expire drops all requests that have expired. NOTE: the caller must hold the
+mutex and store afterwards.
+*/
+func (p *pending) expire() {
+	now := time.Now()
+	for address, request := range p.Requests {
+		if now.After(request.Expires) {
+			delete(p.Requests, address)
+		}
+	}
+}
+
+/*
+store writes the store to disk. NOTE: the caller must hold the mutex.
+*/
+func (p *pending) store() error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.path, data, shared.FILEPERMISSIONMODE)
+}
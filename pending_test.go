@@ -0,0 +1,44 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_PendingPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pending")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadPending(dir + "/" + PENDINGFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	peer := &shared.Peer{Name: "laptop", Trusted: true}
+	isNew, err := store.add("address", peer)
+	if err != nil || !isNew {
+		t.Fatal("Expected new request:", isNew, err)
+	}
+	if isNew, _ = store.add("address", peer); isNew {
+		t.Error("Expected repeated request to not be new")
+	}
+	// must survive a restart
+	store, err = loadPending(dir + "/" + PENDINGFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	request, exists := store.Requests["address"]
+	if !exists || !request.Trusted || request.Name != "laptop" {
+		t.Fatal("Expected request to be loaded, got", request)
+	}
+	// expired requests are dropped
+	request.Expires = time.Now().Add(-time.Second)
+	if _, err := store.take("address"); err != errPeerRequestUnknown {
+		t.Error("Expected expired request to be gone, got", err)
+	}
+}
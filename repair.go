@@ -0,0 +1,284 @@
+package core
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+RepairReport lists the findings of a repair of an encrypted peer.
+*/
+type RepairReport struct {
+	Address    string    // address of the encrypted peer
+	Started    time.Time // start of the repair
+	Finished   time.Time // end of the repair
+	Checked    int       // number of objects in the model of the encrypted peer
+	Present    int       // number of objects the encrypted peer holds
+	Repushed   []string  // paths pushed again from local copies
+	Recovered  []string  // paths fetched from other trusted peers and pushed
+	Lost       []string  // paths no trusted peer has anymore
+	Unanswered []string  // paths the encrypted peer didn't answer for in time
+}
+
+/*
+repairJob is a running repair, audit or collection of an encrypted peer. Lock acceptance and
+missing notifications of the peer are routed to it instead of the normal sync.
+*/
+type repairJob struct {
+	accepted chan bool
+	missing  chan string
+	staged   map[string]string // temp paths of objects fetched from other peers by identification, guarded by the repairs mutex
+	listing  chan []listedObject
+}
+
+/*
+repairs holds the running repairs, audits and collections by address.
+*/
+type repairs struct {
+	mutex       sync.Mutex
+	jobs        map[string]*repairJob
+	collectable map[string]map[string]bool // orphans found by the last dry run by address
+}
+
+func createRepairs() *repairs {
+	return &repairs{
+		jobs:        make(map[string]*repairJob),
+		collectable: make(map[string]map[string]bool)}
+}
+
+/*
+RepairEncrypted checks which objects of its model the encrypted peer at address
+actually holds and pushes missing ones again, either from local copies or from
+other trusted peers. Objects no trusted peer has anymore are reported as lost.
+NOTE: every object is downloaded once to check it, so this blocks for a long
+time and should only be run when the encrypted peer reports missing objects.
+*/
+func (t *Tinzenite) RepairEncrypted(address string) (*RepairReport, error) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return nil, errPeerUnknown
+	}
+	if peer.Trusted {
+		return nil, errNotEncrypted
+	}
+	online, _ := t.channel.IsAddressOnline(address)
+	if !online {
+		return nil, errPeerOffline
+	}
+	job, err := t.startJob(address)
+	if err != nil {
+		return nil, err
+	}
+	defer t.endJob(address, job)
+	err = t.acquireJob(address, job)
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{
+		Address: address,
+		Started: time.Now()}
+	// read the model of the encrypted peer
+	state, err := t.fetchForeign(address, job)
+	if err == nil && state.Empty {
+		err = errRepairNoModel
+	}
+	if err != nil {
+		t.releaseLease(address)
+		return nil, err
+	}
+	var objects []shared.ObjectInfo
+	for _, obj := range state.Objects {
+		if !obj.Directory && !obj.Shadow {
+			objects = append(objects, obj)
+		}
+	}
+	// check every object
+	for _, obj := range objects {
+		report.Checked++
+		ot := t.cInterface.determineObjectTypeBy(obj.Path)
+		path, missing, err := t.probe(address, job, shared.CreateRequestMessage(ot, obj.Identification))
+		if err != nil {
+			report.Unanswered = append(report.Unanswered, obj.Path)
+			continue
+		}
+		if !missing {
+			report.Present++
+			os.Remove(path)
+			continue
+		}
+		// push from the local copy if we have it
+		if _, err := t.model.GetSubPath(obj.Identification); err == nil {
+			t.cInterface.encSendPush(address, obj.Path, obj.Identification)
+			report.Repushed = append(report.Repushed, obj.Path)
+			continue
+		}
+		// otherwise try the other trusted peers and then other encrypted peers
+		t.forgetUpload(address, obj.Identification)
+		path, err = t.fetchFromTrusted(obj.Identification)
+		if err != nil {
+			path, err = t.fetchFromEncrypted(obj.Identification, address)
+		}
+		if err != nil {
+			log.Println("Tinzenite: object", obj.Path, "is lost for encrypted peer", address[:8])
+			report.Lost = append(report.Lost, obj.Path)
+			continue
+		}
+		t.repairs.mutex.Lock()
+		job.staged[obj.Identification] = path
+		t.repairs.mutex.Unlock()
+		t.cInterface.encSendPush(address, obj.Path, obj.Identification)
+		report.Recovered = append(report.Recovered, obj.Path)
+	}
+	// the lease is released once all pushed objects have been uploaded
+	t.pushedAll(address)
+	// staged objects must be kept until then
+	deadline := time.Now().Add(leaseDuration)
+	for t.hasStaged(job) && t.hasLease(address) && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	report.Finished = time.Now()
+	return report, nil
+}
+
+/*
+startJob registers a repair or audit of the encrypted peer at address. Only one
+may run per peer.
+*/
+func (t *Tinzenite) startJob(address string) (*repairJob, error) {
+	job := &repairJob{
+		accepted: make(chan bool, 1),
+		missing:  make(chan string, 1),
+		staged:   make(map[string]string),
+		listing:  make(chan []listedObject, 1)}
+	t.repairs.mutex.Lock()
+	defer t.repairs.mutex.Unlock()
+	if _, running := t.repairs.jobs[address]; running {
+		return nil, errRepairRunning
+	}
+	t.repairs.jobs[address] = job
+	return job, nil
+}
+
+/*
+endJob unregisters the job and removes its staged objects.
+*/
+func (t *Tinzenite) endJob(address string, job *repairJob) {
+	t.repairs.mutex.Lock()
+	delete(t.repairs.jobs, address)
+	staged := job.staged
+	job.staged = make(map[string]string)
+	t.repairs.mutex.Unlock()
+	for _, path := range staged {
+		os.Remove(path)
+	}
+}
+
+/*
+acquireJob locks the encrypted peer at address for the job.
+*/
+func (t *Tinzenite) acquireJob(address string, job *repairJob) error {
+	err := t.requestLease(address)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-job.accepted:
+		return nil
+	case <-time.After(transferTimeout):
+		t.dropLease(address)
+		return errRepairTimeout
+	}
+}
+
+/*
+probe requests the object from the encrypted peer and waits for either the
+file or a missing notification. Returns the path of the received file and
+whether the object is missing.
+*/
+func (t *Tinzenite) probe(address string, job *repairJob, rm shared.RequestMessage) (string, bool, error) {
+	done := make(chan string, 1)
+	err := t.cInterface.requestFile(address, rm, func(address, path string) {
+		done <- path
+	})
+	if err != nil {
+		return "", false, err
+	}
+	timeout := time.After(transferTimeout)
+	for {
+		select {
+		case path := <-done:
+			return path, false, nil
+		case id := <-job.missing:
+			// ignore late notifications of earlier probes
+			if id == rm.Identification {
+				return "", true, nil
+			}
+		case <-timeout:
+			t.cInterface.dropTransfer(transferKey(address, rm.Identification))
+			return "", false, errRepairTimeout
+		}
+	}
+}
+
+/*
+fetchFromTrusted requests the object from all online trusted peers in turn.
+Returns the path of the received file.
+*/
+func (t *Tinzenite) fetchFromTrusted(identification string) (string, error) {
+	for address := range t.peers {
+		trusted, _ := t.isPeerTrusted(address)
+		if !trusted || address == t.selfpeer.Address {
+			continue
+		}
+		done := make(chan string, 1)
+		rm := shared.CreateRequestMessage(shared.OtObject, identification)
+		err := t.cInterface.requestFile(address, rm, func(address, path string) {
+			done <- path
+		})
+		if err != nil {
+			continue
+		}
+		select {
+		case path := <-done:
+			return path, nil
+		case <-time.After(transferTimeout):
+			// allow requesting it from the next peer
+			t.cInterface.dropTransfer(transferKey(address, identification))
+		}
+	}
+	return "", errRepairTimeout
+}
+
+/*
+repairJob returns the running repair of the encrypted peer at address, if any.
+*/
+func (t *Tinzenite) repairJob(address string) *repairJob {
+	t.repairs.mutex.Lock()
+	defer t.repairs.mutex.Unlock()
+	return t.repairs.jobs[address]
+}
+
+/*
+stagedRepair returns the path of an object fetched from another peer for a
+repair of the encrypted peer at address.
+*/
+func (t *Tinzenite) stagedRepair(address, identification string) (string, bool) {
+	t.repairs.mutex.Lock()
+	defer t.repairs.mutex.Unlock()
+	job, exists := t.repairs.jobs[address]
+	if !exists {
+		return "", false
+	}
+	path, exists := job.staged[identification]
+	return path, exists
+}
+
+func (t *Tinzenite) hasStaged(job *repairJob) bool {
+	t.repairs.mutex.Lock()
+	defer t.repairs.mutex.Unlock()
+	return len(job.staged) > 0
+}
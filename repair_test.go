@@ -0,0 +1,42 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_RepairEncryptedPreconditions(t *testing.T) {
+	tin := &Tinzenite{
+		peers: map[string]*shared.Peer{
+			"trustedpeer": &shared.Peer{Address: "trustedpeer", Trusted: true}},
+		repairs: createRepairs()}
+	if _, err := tin.RepairEncrypted("unknownpeer"); err != errPeerUnknown {
+		t.Error("Expected unknown peer error, got", err)
+	}
+	if _, err := tin.RepairEncrypted("trustedpeer"); err != errNotEncrypted {
+		t.Error("Expected not encrypted error, got", err)
+	}
+}
+
+func Test_RepairStaged(t *testing.T) {
+	tin := &Tinzenite{repairs: createRepairs()}
+	if _, exists := tin.stagedRepair("encrypted", "object"); exists {
+		t.Error("Expected nothing staged without a repair")
+	}
+	job := &repairJob{staged: map[string]string{"object": "/tmp/object"}}
+	tin.repairs.jobs["encrypted"] = job
+	if tin.repairJob("encrypted") != job {
+		t.Error("Expected running repair to be found")
+	}
+	path, exists := tin.stagedRepair("encrypted", "object")
+	if !exists || path != "/tmp/object" {
+		t.Error("Expected staged object, got", path, exists)
+	}
+	if _, exists := tin.stagedRepair("encrypted", "other"); exists {
+		t.Error("Expected unknown object to not be staged")
+	}
+	if !tin.hasStaged(job) || tin.hasStaged(&repairJob{staged: map[string]string{}}) {
+		t.Error("Expected only the job with staged objects to have them")
+	}
+}
@@ -0,0 +1,339 @@
+package core
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+ReplicaPolicy states how many encrypted peers must hold every object. A target
+of zero disables the check.
+*/
+type ReplicaPolicy struct {
+	Target int
+}
+
+/*
+ReplicaStatus describes the placement of an object on encrypted peers.
+*/
+type ReplicaStatus struct {
+	Path           string   // sub path of the object
+	Identification string   // identification of the object
+	Replicas       int      // number of encrypted peers holding the object
+	Target         int      // number of encrypted peers that should hold it
+	Peers          []string // addresses of the encrypted peers holding it
+}
+
+/*
+replicas holds the replica policy. The placement itself is the manifest of
+uploads, see integrity.go.
+*/
+type replicas struct {
+	mutex  sync.Mutex
+	policy ReplicaPolicy
+	warned map[string]bool // identifications of objects already reported
+}
+
+func createReplicas() *replicas {
+	return &replicas{warned: make(map[string]bool)}
+}
+
+/*
+SetReplicaPolicy sets how many encrypted peers must hold every object.
+*/
+func (t *Tinzenite) SetReplicaPolicy(policy ReplicaPolicy) {
+	t.replicas.mutex.Lock()
+	t.replicas.policy = policy
+	t.replicas.warned = make(map[string]bool)
+	t.replicas.mutex.Unlock()
+	t.checkReplicas()
+}
+
+/*
+ObjectReplicas returns the placement of the object at sub path.
+*/
+func (t *Tinzenite) ObjectReplicas(subPath string) (ReplicaStatus, error) {
+	stin, exists := t.model.StaticInfos[subPath]
+	if !exists {
+		return ReplicaStatus{}, errObjectUnknown
+	}
+	return t.replicaStatus(subPath, stin.Identification), nil
+}
+
+/*
+UnderReplicated returns all objects held by fewer encrypted peers than the
+policy requires, sorted by path.
+*/
+func (t *Tinzenite) UnderReplicated() []ReplicaStatus {
+	t.replicas.mutex.Lock()
+	target := t.replicas.policy.Target
+	t.replicas.mutex.Unlock()
+	if target <= 0 {
+		return nil
+	}
+	var list []ReplicaStatus
+	for subPath, stin := range t.model.StaticInfos {
+		if stin.Directory {
+			continue
+		}
+		status := t.replicaStatus(subPath, stin.Identification)
+		if status.Replicas < target {
+			list = append(list, status)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+/*
+checkReplicas warns about objects that fell below their replica target, for
+example because an encrypted peer was removed or reported them missing. Every
+object is only reported once until it is replicated again.
+*/
+func (t *Tinzenite) checkReplicas() {
+	list := t.UnderReplicated()
+	below := make(map[string]bool)
+	var fresh []ReplicaStatus
+	t.replicas.mutex.Lock()
+	for _, status := range list {
+		below[status.Identification] = true
+		if !t.replicas.warned[status.Identification] {
+			fresh = append(fresh, status)
+		}
+	}
+	t.replicas.warned = below
+	t.replicas.mutex.Unlock()
+	if len(fresh) == 0 {
+		return
+	}
+	log.Println("Tinzenite: WARNING:", len(fresh), "objects are below their replica target.")
+	if t.replicaWarning != nil {
+		go t.replicaWarning(fresh)
+	}
+}
+
+/*
+placeObjects updates the placement of the encrypted peer at address to the
+objects its model lists. Objects uploaded by other peers are added without a
+hash, as only their presence is known, and objects listed with a different
+version than we uploaded lose their hash; objects the model no longer lists and
+journals no longer listed by the head are marked as orphans.
+*/
+func (t *Tinzenite) placeObjects(address string, state *foreignState) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	held := make(map[string]shared.ObjectInfo)
+	for _, obj := range state.Objects {
+		if !obj.Directory && !obj.Shadow {
+			held[obj.Identification] = obj
+		}
+	}
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	uploads, exists := t.manifest.Peers[peer.Identification]
+	if !exists {
+		uploads = make(map[string]*manifestEntry)
+		t.manifest.Peers[peer.Identification] = uploads
+	}
+	for id, entry := range uploads {
+		// mail and recovery are not part of the model; orphans are kept for the garbage collection
+		if isJournalID(id) {
+			entry.Orphaned = !isLiveJournal(id, state.Head)
+			continue
+		}
+		_, exists := held[id]
+		entry.Orphaned = !exists && !isMailboxID(id) && id != recoveryAuth
+	}
+	for id, obj := range held {
+		entry, exists := uploads[id]
+		if !exists {
+			uploads[id] = &manifestEntry{Version: obj.Version}
+			continue
+		}
+		// a newer version was uploaded by another peer, so our hash no longer applies
+		if !reflect.DeepEqual(entry.Version, obj.Version) {
+			entry.Hash = ""
+			entry.Version = obj.Version
+		}
+	}
+	err := t.manifest.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store manifest:", err)
+	}
+}
+
+/*
+forgetPeerUploads drops the placement of a removed encrypted peer.
+*/
+func (t *Tinzenite) forgetPeerUploads(identification string) {
+	t.manifest.mutex.Lock()
+	_, exists := t.manifest.Peers[identification]
+	delete(t.manifest.Peers, identification)
+	delete(t.manifest.Synced, identification)
+	err := t.manifest.store()
+	t.manifest.mutex.Unlock()
+	if err != nil {
+		log.Println("Tinzenite: failed to store manifest:", err)
+	}
+	if exists {
+		t.checkReplicas()
+	}
+}
+
+/*
+pullSource returns the online encrypted peer holding the object that was synced
+most recently, except for the given address. The time of the last sync is kept
+in the manifest, so the choice survives restarts.
+*/
+func (t *Tinzenite) pullSource(identification, except string) (string, bool) {
+	var source string
+	var latest time.Time
+	found := false
+	for _, address := range t.holders(identification) {
+		if address == except {
+			continue
+		}
+		online, _ := t.channel.IsAddressOnline(address)
+		if !online {
+			continue
+		}
+		synced := t.lastSynced(address)
+		if !found || synced.After(latest) {
+			source = address
+			latest = synced
+			found = true
+		}
+	}
+	return source, found
+}
+
+/*
+syncOrder returns the addresses of all encrypted peers, the most recently synced
+first, so that updates are pulled from the most current peer before others.
+*/
+func (t *Tinzenite) syncOrder() []string {
+	var list []string
+	for address, peer := range t.peers {
+		if !peer.Trusted {
+			list = append(list, address)
+		}
+	}
+	synced := make(map[string]time.Time)
+	for _, address := range list {
+		synced[address] = t.lastSynced(address)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if synced[list[i]].Equal(synced[list[j]]) {
+			return list[i] < list[j]
+		}
+		return synced[list[i]].After(synced[list[j]])
+	})
+	return list
+}
+
+/*
+recordSync notes that a sync with the encrypted peer at address completed.
+*/
+func (t *Tinzenite) recordSync(address string) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	t.manifest.Synced[peer.Identification] = time.Now()
+	err := t.manifest.store()
+	if err != nil {
+		log.Println("Tinzenite: failed to store manifest:", err)
+	}
+}
+
+/*
+lastSynced returns when the encrypted peer at address was last synced, zero if
+never.
+*/
+func (t *Tinzenite) lastSynced(address string) time.Time {
+	peer, exists := t.peers[address]
+	if !exists {
+		return time.Time{}
+	}
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	return t.manifest.Synced[peer.Identification]
+}
+
+/*
+fetchFromEncrypted fetches and decrypts the object from the best encrypted peer
+holding it other than except. Returns the path of the decrypted file.
+*/
+func (t *Tinzenite) fetchFromEncrypted(identification, except string) (string, error) {
+	address, exists := t.pullSource(identification, except)
+	if !exists {
+		return "", errRepairTimeout
+	}
+	job, err := t.startJob(address)
+	if err != nil {
+		return "", err
+	}
+	defer t.endJob(address, job)
+	err = t.acquireJob(address, job)
+	if err != nil {
+		return "", err
+	}
+	defer t.releaseLease(address)
+	data, missing, err := t.fetchBlob(address, job, identification, shared.OtObject)
+	if err == nil && missing {
+		t.forgetUpload(address, identification)
+		t.checkReplicas()
+		err = errRepairTimeout
+	}
+	if err != nil {
+		return "", err
+	}
+	path := t.cInterface.temppath + "/" + address + "." + identification
+	err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+/*
+holders returns the addresses of the encrypted peers holding the object.
+*/
+func (t *Tinzenite) holders(identification string) []string {
+	t.manifest.mutex.Lock()
+	defer t.manifest.mutex.Unlock()
+	var list []string
+	for address, peer := range t.peers {
+		if peer.Trusted {
+			continue
+		}
+		if entry, exists := t.manifest.Peers[peer.Identification][identification]; exists && !entry.Orphaned {
+			list = append(list, address)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (t *Tinzenite) replicaStatus(subPath, identification string) ReplicaStatus {
+	t.replicas.mutex.Lock()
+	target := t.replicas.policy.Target
+	t.replicas.mutex.Unlock()
+	peers := t.holders(identification)
+	return ReplicaStatus{
+		Path:           subPath,
+		Identification: identification,
+		Replicas:       len(peers),
+		Target:         target,
+		Peers:          peers}
+}
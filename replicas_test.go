@@ -0,0 +1,90 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_ReplicaPlacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicas")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadManifest(dir + "/" + MANIFESTFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{
+		peers: map[string]*shared.Peer{
+			"encryptedone": &shared.Peer{Address: "encryptedone", Identification: "one"},
+			"encryptedtwo": &shared.Peer{Address: "encryptedtwo", Identification: "two"},
+			"trustedpeer":  &shared.Peer{Address: "trustedpeer", Identification: "three", Trusted: true}},
+		manifest: store,
+		replicas: createReplicas()}
+	objects := map[string]shared.ObjectInfo{
+		"file": shared.ObjectInfo{Path: "file", Identification: "file"},
+		"dir":  shared.ObjectInfo{Path: "dir", Identification: "dir", Directory: true}}
+	tin.placeObjects("encryptedone", &foreignState{Objects: objects})
+	tin.placeObjects("encryptedtwo", &foreignState{Objects: objects})
+	tin.placeObjects("trustedpeer", &foreignState{Objects: objects})
+	holders := tin.holders("file")
+	if len(holders) != 2 || holders[0] != "encryptedone" || holders[1] != "encryptedtwo" {
+		t.Error("Expected both encrypted peers to hold the file, got", holders)
+	}
+	if len(tin.holders("dir")) != 0 {
+		t.Error("Expected directories to not be placed")
+	}
+	// a newer version uploaded by another peer replaces the one we know of
+	store.Peers["one"]["file"].Hash = "hash"
+	newer := map[string]shared.ObjectInfo{
+		"file": shared.ObjectInfo{Path: "file", Identification: "file", Version: shared.Version{"other": 1}}}
+	tin.placeObjects("encryptedone", &foreignState{Objects: newer})
+	if entry := store.Peers["one"]["file"]; entry.Hash != "" || entry.Version["other"] != 1 {
+		t.Error("Expected entry of the newer version without hash, got", entry)
+	}
+	// objects no longer in the model of a peer are no longer held by it
+	tin.placeObjects("encryptedtwo", &foreignState{Objects: map[string]shared.ObjectInfo{}})
+	if status := tin.replicaStatus("file", "file"); status.Replicas != 1 {
+		t.Error("Expected one replica, got", status)
+	}
+	tin.forgetPeerUploads("one")
+	if len(tin.holders("file")) != 0 {
+		t.Error("Expected removed peer to no longer hold the file")
+	}
+}
+
+func Test_SyncOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicas")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadManifest(dir + "/" + MANIFESTFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{
+		peers: map[string]*shared.Peer{
+			"encryptedone": &shared.Peer{Address: "encryptedone", Identification: "one"},
+			"encryptedtwo": &shared.Peer{Address: "encryptedtwo", Identification: "two"},
+			"trustedpeer":  &shared.Peer{Address: "trustedpeer", Identification: "three", Trusted: true}},
+		manifest: store}
+	tin.recordSync("encryptedtwo")
+	order := tin.syncOrder()
+	if len(order) != 2 || order[0] != "encryptedtwo" || order[1] != "encryptedone" {
+		t.Error("Expected most recently synced encrypted peer first, got", order)
+	}
+	// the time of the last sync survives a restart
+	store, err = loadManifest(dir + "/" + MANIFESTFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin.manifest = store
+	if tin.lastSynced("encryptedtwo").IsZero() || !tin.lastSynced("encryptedone").IsZero() {
+		t.Error("Expected only the synced peer to have a stored sync time")
+	}
+}
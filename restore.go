@@ -0,0 +1,484 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tinzenite/channel"
+	"github.com/tinzenite/model"
+	"github.com/tinzenite/shared"
+)
+
+/*
+recoveryAuth is the identification under which the auth file is kept on
+encrypted peers. Its real identification is only listed in the model, which
+can't be read without it, so a restore requires that a peer pushed it; every
+sync does so, see pushRecovery.
+*/
+const recoveryAuth = "recovery.auth"
+
+/*
+restoreCheckpoint is the number of restored objects after which the model is
+stored, so that an interrupted restore only repeats that many.
+*/
+const restoreCheckpoint = 64
+
+/*
+Phases of a restore from an encrypted peer.
+*/
+const (
+	RestoreConnecting = "connecting"
+	RestoreUnlocking  = "unlocking"
+	RestoreObjects    = "restoring"
+	RestoreDone       = "done"
+)
+
+/*
+RestoreProgress describes a running or interrupted restore. It is kept in the
+local store directory so that it can be read while the restore runs and so that
+the restore can be resumed.
+*/
+type RestoreProgress struct {
+	Address  string    // address of the encrypted peer restored from
+	Phase    string    // current phase of the restore
+	Total    int       // number of objects to restore, zero until the model has been read
+	Restored int       // number of objects restored so far
+	Missing  []string  // paths the encrypted peer doesn't hold
+	Failed   []string  // paths that could not be applied
+	Updated  time.Time // time of the last progress
+}
+
+/*
+RestoreFromEncrypted rebuilds the Tinzenite directory at dirpath from the
+encrypted peer at encryptedAddress, for when all trusted peers have been lost.
+The auth file is fetched and unlocked with the password, then the model and all
+objects are downloaded and decrypted. Finally this peer registers itself with
+the network as a new trusted peer. Blocks until done, which can take very long;
+see RestoreStatus for the progress. If interrupted, calling it again with the
+same dirpath resumes where it stopped. NOTE: dirpath should be empty. NOTE: only
+encrypted peers that were synced since recovery auth files were introduced can
+be restored from, as older ones hold the auth file only under an identification
+that is unknown without it.
+*/
+func RestoreFromEncrypted(dirpath, encryptedAddress, peername, password string) (*Tinzenite, error) {
+	if len(encryptedAddress) < 8 {
+		return nil, errAddressInvalid
+	}
+	progress, err := loadRestoreProgress(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	resuming := progress != nil && progress.Phase != RestoreDone
+	if shared.IsTinzenite(dirpath) && !resuming {
+		return nil, shared.ErrIsTinzenite
+	}
+	// flag whether we have to close the channel after us, .tinzenite is kept to resume
+	var failed bool
+	// flag whether the restore can be resumed after a failure
+	resumable := resuming
+	t := &Tinzenite{Path: dirpath}
+	t.cInterface = createChannelInterface(t)
+	if resuming {
+		// keep the identity the encrypted peer already knows
+		selfToxDump, err := shared.LoadToxDumpFrom(dirpath + "/" + shared.STORETOXDUMPDIR)
+		if err != nil {
+			return nil, err
+		}
+		t.selfpeer = selfToxDump.SelfPeer
+		err = t.loadStores()
+		if err != nil {
+			return nil, err
+		}
+		channel, err := channel.Create(t.selfpeer.Name, selfToxDump.ToxData, t.cInterface)
+		if err != nil {
+			return nil, err
+		}
+		t.channel = channel
+		log.Println("Tinzenite: resuming restore from", encryptedAddress[:8])
+	} else {
+		// until the progress is stored the restore can't be resumed, so don't leave a half made directory
+		defer func() {
+			if !resumable {
+				os.RemoveAll(dirpath + "/" + shared.TINZENITEDIR)
+			}
+		}()
+		err := shared.MakeTinzeniteDir(dirpath)
+		if err != nil {
+			return nil, err
+		}
+		err = t.loadStores()
+		if err != nil {
+			return nil, err
+		}
+		channel, err := channel.Create(peername, nil, t.cInterface)
+		if err != nil {
+			return nil, err
+		}
+		t.channel = channel
+		progress = &RestoreProgress{}
+	}
+	// close channel if we fail from here on
+	defer func() {
+		if failed {
+			t.channel.Close()
+		}
+	}()
+	if !resuming {
+		address, err := t.channel.Address()
+		if err != nil {
+			failed = true
+			return nil, err
+		}
+		peer, err := shared.CreatePeer(peername, address, true)
+		if err != nil {
+			failed = true
+			return nil, err
+		}
+		t.selfpeer = peer
+		// store the identity at once so that an interrupted restore can be resumed
+		toxData, err := t.channel.ToxData()
+		if err != nil {
+			failed = true
+			return nil, err
+		}
+		toxPeerDump := &shared.ToxPeerDump{
+			SelfPeer: t.selfpeer,
+			ToxData:  toxData}
+		err = toxPeerDump.StoreTo(dirpath + "/" + shared.STORETOXDUMPDIR)
+		if err != nil {
+			failed = true
+			return nil, err
+		}
+	}
+	progress.Address = encryptedAddress
+	// from here on an interrupted restore is resumed
+	progress.Updated = time.Now()
+	err = writeJSON(dirpath+"/"+shared.STOREMODELDIR+"/"+RESTOREFILE, progress)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	resumable = true
+	t.peers = make(map[string]*shared.Peer)
+	t.peers[t.selfpeer.Address] = t.selfpeer
+	// messages are only accepted from known peers, the real one is restored later
+	encrypted, err := shared.CreatePeer(encryptedAddress[:8], encryptedAddress, false)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	t.peers[encryptedAddress] = encrypted
+	err = t.restore(encryptedAddress, password, progress, resuming)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	err = t.finishRestore(encryptedAddress, progress)
+	if err != nil {
+		failed = true
+		return nil, err
+	}
+	// register with the network by uploading our peer file
+	err = t.SyncEncrypted()
+	if err != nil {
+		// not fatal: the next sync will catch up
+		log.Println("Tinzenite: initial sync failed:", err)
+	}
+	return t, nil
+}
+
+/*
+RestoreStatus returns the progress of the running or last restore of the
+directory at dirpath.
+*/
+func RestoreStatus(dirpath string) (*RestoreProgress, error) {
+	progress, err := loadRestoreProgress(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	if progress == nil {
+		return nil, errRestoreUnknown
+	}
+	return progress, nil
+}
+
+/*
+restore connects to the encrypted peer at address, unlocks its auth file and
+applies all objects of its model.
+*/
+func (t *Tinzenite) restore(address, password string, progress *RestoreProgress, resuming bool) error {
+	t.restorePhase(progress, RestoreConnecting)
+	online, _ := t.channel.IsAddressOnline(address)
+	if !online {
+		message, err := buildFriendRequest(t.selfpeer, "")
+		if err != nil {
+			return err
+		}
+		err = t.channel.RequestConnection(address, message)
+		// when resuming we may already be friends
+		if err != nil && !resuming {
+			return err
+		}
+		log.Println("Tinzenite: waiting for", address[:8], "to accept.")
+		err = t.awaitAcceptance(address)
+		if err != nil {
+			return err
+		}
+	}
+	job, err := t.startJob(address)
+	if err != nil {
+		return err
+	}
+	defer t.endJob(address, job)
+	err = t.acquireJob(address, job)
+	if err != nil {
+		return err
+	}
+	defer t.releaseLease(address)
+	t.restorePhase(progress, RestoreUnlocking)
+	// the auth file is stored unencrypted
+	path, missing, err := t.probe(address, job, shared.CreateRequestMessage(shared.OtAuth, recoveryAuth))
+	if err == nil && missing {
+		err = errRestoreNoAuth
+	}
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	os.Remove(path)
+	if err != nil {
+		return err
+	}
+	auth, err := readAuthentication(data, password)
+	if err != nil {
+		return err
+	}
+	t.auth = auth
+	state, err := t.fetchForeign(address, job)
+	if err == nil && state.Empty {
+		err = errRepairNoModel
+	}
+	if err != nil {
+		return err
+	}
+	// the model is created once, after that it tells what has been restored
+	if progress.Total == 0 {
+		t.model, err = model.Create(t.Path, t.selfpeer.Identification, t.Path+"/"+shared.STOREMODELDIR)
+		if err == nil {
+			err = t.model.Store()
+		}
+	} else {
+		t.model, err = model.LoadFrom(t.Path + "/" + shared.STOREMODELDIR)
+	}
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for path, obj := range state.Objects {
+		// objects without content are restored by the next sync
+		if path == "" || obj.Shadow {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	// parents before their children
+	sort.Strings(paths)
+	progress.Total = len(paths)
+	progress.Restored = 0
+	progress.Missing = nil
+	progress.Failed = nil
+	t.restorePhase(progress, RestoreObjects)
+	renewed := time.Now()
+	unstored := 0
+	for _, path := range paths {
+		if time.Since(renewed) > leaseRenewal {
+			t.renewLeases()
+			renewed = time.Now()
+		}
+		// restored before the restore was interrupted
+		if _, exists := t.model.StaticInfos[path]; exists {
+			progress.Restored++
+			continue
+		}
+		obj := state.Objects[path]
+		missing, err := t.restoreObject(address, job, obj)
+		if err == errRepairTimeout {
+			// stop here, the restore can be resumed
+			t.model.Store()
+			t.storeRestoreProgress(progress)
+			return err
+		}
+		if missing {
+			log.Println("Tinzenite: object", path, "is missing on encrypted peer", address[:8])
+			progress.Missing = append(progress.Missing, path)
+		} else if err != nil {
+			log.Println("Tinzenite: failed to restore", path, ":", err)
+			progress.Failed = append(progress.Failed, path)
+		} else {
+			progress.Restored++
+		}
+		unstored++
+		if unstored >= restoreCheckpoint {
+			err = t.model.Store()
+			if err != nil {
+				return err
+			}
+			unstored = 0
+			log.Println("Tinzenite: restored", progress.Restored, "of", progress.Total, "objects.")
+		}
+		t.storeRestoreProgress(progress)
+	}
+	return t.model.Store()
+}
+
+/*
+restoreObject fetches the object from the encrypted peer at address and applies
+it to the model. Returns true if the encrypted peer doesn't hold it.
+*/
+func (t *Tinzenite) restoreObject(address string, job *repairJob, obj shared.ObjectInfo) (bool, error) {
+	msg := shared.CreateUpdateMessage(shared.OpCreate, obj)
+	if obj.Directory {
+		return false, t.model.ApplyUpdateMessage(&msg)
+	}
+	ot := t.cInterface.determineObjectTypeBy(obj.Path)
+	var data []byte
+	if ot == shared.OtAuth || ot == shared.OtPeer {
+		// auth and peers are stored unencrypted
+		path, missing, err := t.probe(address, job, shared.CreateRequestMessage(ot, obj.Identification))
+		if err != nil || missing {
+			return missing, err
+		}
+		data, err = ioutil.ReadFile(path)
+		os.Remove(path)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		var missing bool
+		var err error
+		data, missing, err = t.fetchBlob(address, job, obj.Identification, ot)
+		if err != nil || missing {
+			return missing, err
+		}
+	}
+	// a file left by an interrupted restore is replaced, anything else conflicts
+	existing, err := ioutil.ReadFile(t.Path + "/" + obj.Path)
+	if err == nil && bytes.Equal(existing, data) {
+		os.Remove(t.Path + "/" + obj.Path)
+	}
+	// the model expects created files in the temp dir
+	err = ioutil.WriteFile(t.cInterface.temppath+"/"+obj.Identification, data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return false, err
+	}
+	return false, t.model.ApplyUpdateMessage(&msg)
+}
+
+/*
+finishRestore makes the restored directory a Tinzenite directory with this peer
+as a new trusted peer of the network.
+*/
+func (t *Tinzenite) finishRestore(address string, progress *RestoreProgress) error {
+	peers, err := shared.LoadPeers(t.Path)
+	if err != nil {
+		return err
+	}
+	// the lost peers are kept, they can be removed once they are known to be gone
+	peers[t.selfpeer.Address] = t.selfpeer
+	if _, exists := peers[address]; !exists {
+		peers[address] = t.peers[address]
+	}
+	t.peers = peers
+	// store everything, this also adds our own peer file
+	err = t.Store()
+	if err != nil {
+		return err
+	}
+	// save that this directory is now a tinzenite dir
+	err = shared.WriteDirectoryList(t.Path)
+	if err != nil {
+		return err
+	}
+	err = t.initialize()
+	if err != nil {
+		return err
+	}
+	t.restorePhase(progress, RestoreDone)
+	log.Println("Tinzenite: restored", progress.Restored, "of", progress.Total, "objects,",
+		len(progress.Missing), "missing and", len(progress.Failed), "failed.")
+	return nil
+}
+
+/*
+pushRecovery uploads the auth file to the encrypted peer at address under its
+recovery identification if it changed since the last upload. NOTE: the peer must
+be locked.
+*/
+func (t *Tinzenite) pushRecovery(address string) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return
+	}
+	data, err := json.Marshal(t.auth)
+	if err != nil {
+		log.Println("Tinzenite: failed to build recovery:", err)
+		return
+	}
+	// auth is uploaded unencrypted, so the manifest holds the hash of its content
+	t.manifest.mutex.Lock()
+	entry, uploaded := t.manifest.Peers[peer.Identification][recoveryAuth]
+	t.manifest.mutex.Unlock()
+	if uploaded && entry.Hash == hashData(data) {
+		return
+	}
+	err = t.prepareBlob(address, recoveryAuth, t.auth)
+	if err != nil {
+		log.Println("Tinzenite: failed to prepare recovery:", err)
+		return
+	}
+	pm := shared.CreatePushMessage(recoveryAuth, shared.OtAuth)
+	t.expectUpload(address, recoveryAuth)
+	t.channel.Send(address, pm.JSON())
+}
+
+/*
+restorePhase enters the phase of the restore.
+*/
+func (t *Tinzenite) restorePhase(progress *RestoreProgress, phase string) {
+	log.Println("Tinzenite: restore:", phase)
+	progress.Phase = phase
+	t.storeRestoreProgress(progress)
+}
+
+func (t *Tinzenite) storeRestoreProgress(progress *RestoreProgress) {
+	progress.Updated = time.Now()
+	err := writeJSON(t.Path+"/"+shared.STOREMODELDIR+"/"+RESTOREFILE, progress)
+	if err != nil {
+		log.Println("Tinzenite: failed to store restore progress:", err)
+	}
+}
+
+/*
+loadRestoreProgress returns the progress of the restore of the directory at
+dirpath, or nil if it was never restored.
+*/
+func loadRestoreProgress(dirpath string) (*RestoreProgress, error) {
+	data, err := ioutil.ReadFile(dirpath + "/" + shared.STOREMODELDIR + "/" + RESTOREFILE)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	progress := &RestoreProgress{}
+	err = json.Unmarshal(data, progress)
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
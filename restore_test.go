@@ -0,0 +1,66 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_RestoreProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(dir+"/"+shared.STOREMODELDIR, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	_, err = RestoreStatus(dir)
+	if err != errRestoreUnknown {
+		t.Error("Expected unknown restore, got", err)
+	}
+	tin := &Tinzenite{Path: dir}
+	progress := &RestoreProgress{Address: "encrypted", Total: 2}
+	tin.restorePhase(progress, RestoreObjects)
+	progress.Restored++
+	progress.Missing = append(progress.Missing, "file")
+	tin.storeRestoreProgress(progress)
+	loaded, err := RestoreStatus(dir)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	if loaded.Phase != RestoreObjects || loaded.Total != 2 || loaded.Restored != 1 || len(loaded.Missing) != 1 {
+		t.Error("Expected stored progress, got", loaded)
+	}
+}
+
+func Test_RecoveryNotOrphaned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadManifest(dir + "/" + MANIFESTFILE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	tin := &Tinzenite{
+		peers: map[string]*shared.Peer{
+			"encryptedpeer": &shared.Peer{Address: "encryptedpeer", Identification: "encrypted"}},
+		manifest: store,
+		replicas: createReplicas()}
+	store.Peers["encrypted"] = map[string]*manifestEntry{recoveryAuth: &manifestEntry{Hash: "hash"}}
+	tin.placeObjects("encryptedpeer", &foreignState{Objects: map[string]shared.ObjectInfo{}})
+	if len(tin.holders(recoveryAuth)) != 1 {
+		t.Error("Expected recovery auth to be kept")
+	}
+}
+
+func Test_RestoreInvalidAddress(t *testing.T) {
+	if _, err := RestoreFromEncrypted(os.TempDir(), "short", "peer", "password"); err != errAddressInvalid {
+		t.Error("Expected invalid address to be rejected, got", err)
+	}
+}
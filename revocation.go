@@ -0,0 +1,165 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+revocation is the persisted record of a removed peer. Revocations are stored as
+one file per peer in the org directory, so that they are synchronized to all
+peers like any other file and every peer can act on them.
+*/
+type revocation struct {
+	Identification string    // identification of the removed peer
+	Address        string    // address of the removed peer
+	Name           string    // name of the removed peer at the time of removal
+	Time           time.Time // time of removal
+	By             string    // identification of the peer that removed it
+}
+
+/*
+revokePeer writes the revocation for the given peer and applies it to the model,
+which distributes it to all other peers.
+*/
+func (t *Tinzenite) revokePeer(peer *shared.Peer) error {
+	rev := revocation{
+		Identification: peer.Identification,
+		Address:        peer.Address,
+		Name:           peer.Name,
+		Time:           time.Now(),
+		By:             t.selfpeer.Identification}
+	data, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := t.revocationPath()
+	err = os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(dir+"/"+peer.Identification+shared.ENDING, data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	// remember locally right away, unless it is held for approval
+	if !t.needsApproval() {
+		t.revoked[peer.Address] = true
+		t.revoked[peer.Identification] = true
+	}
+	// let the model pick it up so that it is sent to all peers
+	return t.model.PartialUpdate(dir)
+}
+
+/*
+loadRevocations reads all revocations from disk.
+*/
+func (t *Tinzenite) loadRevocations() ([]revocation, error) {
+	stats, err := ioutil.ReadDir(t.revocationPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []revocation
+	for _, stat := range stats {
+		if stat.IsDir() || !strings.HasSuffix(stat.Name(), shared.ENDING) {
+			continue
+		}
+		data, err := ioutil.ReadFile(t.revocationPath() + "/" + stat.Name())
+		if err != nil {
+			return nil, err
+		}
+		rev := revocation{}
+		err = json.Unmarshal(data, &rev)
+		if err != nil {
+			log.Println("Tinzenite: ignoring invalid revocation", stat.Name(), ":", err)
+			continue
+		}
+		list = append(list, rev)
+	}
+	return list, nil
+}
+
+/*
+applyRevocations reloads the revocations and removes all revoked peers that are
+still known.
+*/
+func (t *Tinzenite) applyRevocations() error {
+	list, err := t.loadRevocations()
+	if err != nil {
+		return err
+	}
+	for _, rev := range list {
+		if rev.Identification == t.selfpeer.Identification {
+			log.Println("Tinzenite: WARNING: this peer has been removed from the network by", rev.By)
+			continue
+		}
+		t.revoked[rev.Address] = true
+		t.revoked[rev.Identification] = true
+	}
+	for address, peer := range t.peers {
+		if address == t.selfpeer.Address {
+			continue
+		}
+		if !t.isRevoked(address) && !t.revoked[peer.Identification] {
+			continue
+		}
+		log.Println("Tinzenite: removing revoked peer", peer.Name, "at", address[:8])
+		t.purgePeer(peer)
+		delete(t.peers, address)
+	}
+	return nil
+}
+
+/*
+purgePeer removes all local traces of the peer except for its peer file: the
+channel connection, pending friend requests and challenges, its entries in
+outstanding removals, and the objects it holds if it is encrypted.
+*/
+func (t *Tinzenite) purgePeer(peer *shared.Peer) {
+	// remove from channel
+	err := t.channel.RemoveConnection(peer.Address)
+	if err != nil {
+		log.Println("Tinzenite: failed to remove connection of peer:", err)
+	}
+	err = t.pending.remove(peer.Address)
+	if err != nil {
+		log.Println("Tinzenite: failed to remove friend request of peer:", err)
+	}
+	delete(t.cInterface.challenges, peer.Address)
+	// objects held only by it are now below their replica target
+	if !peer.Trusted {
+		t.forgetPeerUploads(peer.Identification)
+	}
+	// write peer to all removals so that no removals will be orphaned
+	removePath := t.Path + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR
+	allRemovals, _ := ioutil.ReadDir(removePath)
+	// for every object that is currently being removed
+	for _, stat := range allRemovals {
+		// write the to be removed peer as done
+		err := t.model.UpdateRemovalDir(stat.Name(), peer.Identification)
+		if err != nil {
+			// warn if it failed
+			log.Println("Tinzenite: failed to purge removed peer from removal!")
+		}
+	}
+}
+
+/*
+isRevoked returns true if the address belongs to a removed peer.
+*/
+func (t *Tinzenite) isRevoked(address string) bool {
+	return t.revoked[address]
+}
+
+func (t *Tinzenite) revocationPath() string {
+	return t.Path + "/" + shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + REVOKEDDIR
+}
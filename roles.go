@@ -0,0 +1,358 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+ReadOnlyPolicy decides what happens to local edits on a read-only peer.
+*/
+type ReadOnlyPolicy int
+
+const (
+	// ReadOnlyKeepLocal keeps local edits as local only divergences.
+	ReadOnlyKeepLocal ReadOnlyPolicy = iota
+	// ReadOnlyRevert undoes local edits by fetching the content from a writing peer.
+	ReadOnlyRevert
+)
+
+/*
+peerRole is the persisted role of a peer. As the peer files belong to the shared
+library the role is stored in its own file per peer in the org directory, so
+that it is synchronized to all peers.
+*/
+type peerRole struct {
+	Identification string    // identification of the peer
+	ReadOnly       bool      // whether the peer may not publish changes
+	Admin          bool      // whether the peer may change the org directory
+	Time           time.Time // time the role was set
+	By             string    // identification of the peer that set the role
+}
+
+/*
+roles caches the roles read from the org directory along with the handling of
+local edits on this peer if it is read-only.
+*/
+type roles struct {
+	mutex     sync.Mutex
+	readOnly  map[string]bool // identifications of read-only peers
+	admin     map[string]bool // identifications of admin peers
+	policy    ReadOnlyPolicy
+	reverting map[string]bool // sub paths whose next local update stems from a revert
+}
+
+func createRoles() *roles {
+	return &roles{
+		readOnly:  make(map[string]bool),
+		admin:     make(map[string]bool),
+		policy:    ReadOnlyKeepLocal,
+		reverting: make(map[string]bool)}
+}
+
+/*
+SetReadOnly sets whether the peer at address may publish changes. The role is
+distributed to all peers.
+*/
+func (t *Tinzenite) SetReadOnly(address string, readOnly bool) error {
+	peer, exists := t.peers[address]
+	if !exists {
+		return errPeerUnknown
+	}
+	t.roles.mutex.Lock()
+	admin := t.roles.admin[peer.Identification]
+	t.roles.mutex.Unlock()
+	return t.writeRole(peer, readOnly, admin)
+}
+
+/*
+SetAdmin sets whether the peer at address may change the org directory. As
+long as no admin exists every trusted peer may, so the first admin can be set
+by anyone.
+*/
+func (t *Tinzenite) SetAdmin(address string, admin bool) error {
+	peer, exists := t.peers[address]
+	if !exists {
+		return errPeerUnknown
+	}
+	t.roles.mutex.Lock()
+	readOnly := t.roles.readOnly[peer.Identification]
+	t.roles.mutex.Unlock()
+	return t.writeRole(peer, readOnly, admin)
+}
+
+/*
+IsAdmin returns true if the peer at address may change the org directory.
+*/
+func (t *Tinzenite) IsAdmin(address string) bool {
+	peer, exists := t.peers[address]
+	if !exists {
+		return false
+	}
+	t.roles.mutex.Lock()
+	defer t.roles.mutex.Unlock()
+	return t.roles.admin[peer.Identification]
+}
+
+/*
+writeRole stores the role of the peer, removing the file if the peer has the
+default role.
+*/
+func (t *Tinzenite) writeRole(peer *shared.Peer, readOnly, admin bool) error {
+	err := t.requireAdmin()
+	if err != nil {
+		return err
+	}
+	dir := t.rolePath()
+	path := dir + "/" + peer.Identification + shared.ENDING
+	if readOnly || admin {
+		role := peerRole{
+			Identification: peer.Identification,
+			ReadOnly:       readOnly,
+			Admin:          admin,
+			Time:           time.Now(),
+			By:             t.selfpeer.Identification}
+		data, err := json.MarshalIndent(role, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// a held change is loaded once approved
+	if !t.needsApproval() {
+		t.roles.mutex.Lock()
+		t.roles.readOnly[peer.Identification] = readOnly
+		t.roles.admin[peer.Identification] = admin
+		t.roles.mutex.Unlock()
+	}
+	// let the model pick it up so that it is sent to all peers
+	return t.model.PartialUpdate(dir)
+}
+
+/*
+IsReadOnly returns true if the peer at address may not publish changes.
+*/
+func (t *Tinzenite) IsReadOnly(address string) bool {
+	peer, exists := t.peers[address]
+	if !exists {
+		return false
+	}
+	t.roles.mutex.Lock()
+	defer t.roles.mutex.Unlock()
+	return t.roles.readOnly[peer.Identification]
+}
+
+/*
+SetReadOnlyPolicy sets how local edits are handled while this peer is read-only.
+*/
+func (t *Tinzenite) SetReadOnlyPolicy(policy ReadOnlyPolicy) {
+	t.roles.mutex.Lock()
+	defer t.roles.mutex.Unlock()
+	t.roles.policy = policy
+}
+
+/*
+loadRoles rereads all roles from disk.
+*/
+func (t *Tinzenite) loadRoles() error {
+	readOnly := make(map[string]bool)
+	admin := make(map[string]bool)
+	stats, err := ioutil.ReadDir(t.rolePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, stat := range stats {
+		if stat.IsDir() || !strings.HasSuffix(stat.Name(), shared.ENDING) {
+			continue
+		}
+		data, err := ioutil.ReadFile(t.rolePath() + "/" + stat.Name())
+		if err != nil {
+			return err
+		}
+		role := peerRole{}
+		err = json.Unmarshal(data, &role)
+		if err != nil {
+			log.Println("Tinzenite: ignoring invalid role", stat.Name(), ":", err)
+			continue
+		}
+		if role.ReadOnly {
+			readOnly[role.Identification] = true
+		}
+		if role.Admin {
+			admin[role.Identification] = true
+		}
+	}
+	t.roles.mutex.Lock()
+	t.roles.readOnly = readOnly
+	t.roles.admin = admin
+	t.roles.mutex.Unlock()
+	return nil
+}
+
+/*
+suppressLocal handles a local update on a read-only peer instead of sending it.
+*/
+func (t *Tinzenite) suppressLocal(msg shared.UpdateMessage) {
+	t.roles.mutex.Lock()
+	reverted := t.roles.reverting[msg.Object.Path]
+	delete(t.roles.reverting, msg.Object.Path)
+	policy := t.roles.policy
+	t.roles.mutex.Unlock()
+	// updates caused by reverting are expected
+	if reverted {
+		return
+	}
+	if policy == ReadOnlyKeepLocal {
+		log.Println("Tinzenite: read-only, keeping", msg.Operation, "of", msg.Object.Path, "local.")
+		return
+	}
+	log.Println("Tinzenite: read-only, reverting", msg.Operation, "of", msg.Object.Path, ".")
+	// only requests are sent here, the content is applied once it arrives
+	err := t.revertLocal(msg)
+	if err != nil {
+		log.Println("Tinzenite: failed to revert local change:", err)
+	}
+}
+
+/*
+revertLocal undoes a local change. Created objects are removed, while modified
+or removed files are fetched again from the writing peers in turn. Reverted
+files get back the version they had before the change, so that the next update
+of a writing peer applies without conflict. NOTE: the content of removed
+directories is not restored.
+*/
+func (t *Tinzenite) revertLocal(msg shared.UpdateMessage) error {
+	fullPath := t.Path + "/" + msg.Object.Path
+	switch msg.Operation {
+	case shared.OpCreate:
+		t.markReverting(msg.Object.Path)
+		err := os.RemoveAll(fullPath)
+		if err != nil {
+			return err
+		}
+		return t.model.PartialUpdate(filepath.Dir(fullPath))
+	case shared.OpRemove:
+		if msg.Object.Directory {
+			log.Println("Tinzenite: recreating removed directory", msg.Object.Path, "without content.")
+			t.markReverting(msg.Object.Path)
+			err := os.MkdirAll(fullPath, shared.FILEPERMISSIONMODE)
+			if err != nil {
+				return err
+			}
+			return t.model.PartialUpdate(fullPath)
+		}
+	}
+	var writers []string
+	for address := range t.peers {
+		trusted, _ := t.isPeerTrusted(address)
+		if trusted && !t.IsReadOnly(address) {
+			writers = append(writers, address)
+		}
+	}
+	if len(writers) == 0 {
+		return errNoWriter
+	}
+	t.fetchReverted(writers, msg)
+	return nil
+}
+
+/*
+fetchReverted requests the published content of the reverted object from the
+first of the writers, moving on to the next one if it doesn't arrive in time.
+Once it arrives the object is restored through the model.
+*/
+func (t *Tinzenite) fetchReverted(writers []string, msg shared.UpdateMessage) {
+	if len(writers) == 0 {
+		log.Println("Tinzenite: no writing peer delivered", msg.Object.Path, "to revert it.")
+		return
+	}
+	address := writers[0]
+	received := make(chan bool, 1)
+	rm := shared.CreateRequestMessage(shared.OtObject, msg.Object.Identification)
+	err := t.cInterface.requestFile(address, rm, func(address, path string) {
+		received <- true
+		err := t.applyReverted(msg, path)
+		if err != nil {
+			log.Println("Tinzenite: failed to apply reverted file:", err)
+		}
+	})
+	if err != nil {
+		t.fetchReverted(writers[1:], msg)
+		return
+	}
+	time.AfterFunc(transferTimeout, func() {
+		select {
+		case <-received:
+		default:
+			t.cInterface.dropTransfer(transferKey(address, msg.Object.Identification))
+			t.fetchReverted(writers[1:], msg)
+		}
+	})
+}
+
+/*
+applyReverted writes the fetched content at path back through the model. A
+modify gets the version it had before the local change, while a removed file is
+created again with the version it was removed with.
+*/
+func (t *Tinzenite) applyReverted(msg shared.UpdateMessage, path string) error {
+	// the model expects the content in the temp dir
+	err := os.Rename(path, t.cInterface.temppath+"/"+msg.Object.Identification)
+	if err != nil {
+		return err
+	}
+	obj := msg.Object
+	op := shared.OpCreate
+	if msg.Operation == shared.OpModify {
+		op = shared.OpModify
+		obj.Version = previousVersion(obj.Version, t.selfpeer.Identification)
+	}
+	t.markReverting(obj.Path)
+	um := shared.CreateUpdateMessage(op, obj)
+	return t.model.ApplyUpdateMessage(&um)
+}
+
+/*
+previousVersion returns the version before the given peer increased it once.
+*/
+func previousVersion(version shared.Version, identification string) shared.Version {
+	previous := make(shared.Version)
+	for id, count := range version {
+		previous[id] = count
+	}
+	previous[identification]--
+	if previous[identification] <= 0 {
+		delete(previous, identification)
+	}
+	return previous
+}
+
+func (t *Tinzenite) markReverting(subPath string) {
+	t.roles.mutex.Lock()
+	defer t.roles.mutex.Unlock()
+	t.roles.reverting[subPath] = true
+}
+
+func (t *Tinzenite) rolePath() string {
+	return t.Path + "/" + shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + ROLESDIR
+}
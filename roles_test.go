@@ -0,0 +1,60 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_LoadRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roles")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	defer os.RemoveAll(dir)
+	tin := &Tinzenite{
+		Path: dir,
+		peers: map[string]*shared.Peer{
+			"reader": {Identification: "readerID", Trusted: true},
+			"writer": {Identification: "writerID", Trusted: true}},
+		roles: createRoles()}
+	err = os.MkdirAll(tin.rolePath(), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	data, _ := json.Marshal(peerRole{Identification: "readerID", ReadOnly: true})
+	err = ioutil.WriteFile(tin.rolePath()+"/readerID"+shared.ENDING, data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	err = tin.loadRoles()
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	if !tin.IsReadOnly("reader") {
+		t.Error("Expected reader to be read-only")
+	}
+	if tin.IsReadOnly("writer") || tin.IsReadOnly("unknown") {
+		t.Error("Expected writer and unknown peers to not be read-only")
+	}
+	// removing the role file makes the peer a writer again
+	os.Remove(tin.rolePath() + "/readerID" + shared.ENDING)
+	tin.loadRoles()
+	if tin.IsReadOnly("reader") {
+		t.Error("Expected reader to be writer again")
+	}
+}
+
+func Test_PreviousVersion(t *testing.T) {
+	version := shared.Version{"selfID": 2, "otherID": 3}
+	previous := previousVersion(version, "selfID")
+	if previous["selfID"] != 1 || previous["otherID"] != 3 || version["selfID"] != 2 {
+		t.Error("Expected own count to be decreased on a copy, got", previous)
+	}
+	if _, exists := previousVersion(previous, "selfID")["selfID"]; exists {
+		t.Error("Expected own count to be dropped once zero")
+	}
+}
@@ -0,0 +1,257 @@
+package core
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+maxEncryptedBackoff is the longest wait between automatic syncs that failed.
+*/
+const maxEncryptedBackoff = 1 * time.Hour
+
+/*
+EncryptedPolicy configures when encrypted peers are synchronized automatically.
+A zero duration disables the respective trigger.
+*/
+type EncryptedPolicy struct {
+	Interval  time.Duration // sync at least this often
+	Settle    time.Duration // sync once no local changes happened for this long
+	OnConnect bool          // sync when an encrypted peer comes online
+}
+
+var defaultEncryptedPolicy = EncryptedPolicy{
+	Interval:  30 * time.Minute,
+	Settle:    1 * time.Minute,
+	OnConnect: true}
+
+/*
+EncryptedStatus is the state of the automatic synchronization with an encrypted
+peer.
+*/
+type EncryptedStatus struct {
+	Address     string        // address of the encrypted peer
+	Locked      bool          // whether a sync is currently in progress
+	LastAttempt time.Time     // last time a sync was started
+	LastSuccess time.Time     // last time a sync completed
+	LastError   string        // reason the last sync failed, empty if it didn't
+	Backoff     time.Duration // time waited before retrying after failures
+}
+
+/*
+schedule holds the state of the automatic encrypted syncs.
+*/
+type schedule struct {
+	mutex   sync.Mutex
+	policy  EncryptedPolicy
+	changed time.Time // last local change not yet synced, zero if none
+	peers   map[string]*scheduleState
+}
+
+/*
+scheduleState is the state of the automatic syncs of a single encrypted peer.
+*/
+type scheduleState struct {
+	status EncryptedStatus
+	next   time.Time // no automatic sync before this time
+}
+
+func createSchedule() *schedule {
+	return &schedule{
+		policy: defaultEncryptedPolicy,
+		peers:  make(map[string]*scheduleState)}
+}
+
+/*
+SetEncryptedPolicy sets when encrypted peers are synchronized automatically.
+*/
+func (t *Tinzenite) SetEncryptedPolicy(policy EncryptedPolicy) {
+	t.schedule.mutex.Lock()
+	defer t.schedule.mutex.Unlock()
+	t.schedule.policy = policy
+}
+
+/*
+EncryptedStatus returns the sync status of the encrypted peer at address.
+*/
+func (t *Tinzenite) EncryptedStatus(address string) (EncryptedStatus, error) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return EncryptedStatus{}, errPeerUnknown
+	}
+	if peer.Trusted {
+		return EncryptedStatus{}, errNotEncrypted
+	}
+	return t.encryptedStatus(address), nil
+}
+
+/*
+EncryptedStatuses returns the sync status of all encrypted peers.
+*/
+func (t *Tinzenite) EncryptedStatuses() []EncryptedStatus {
+	var list []EncryptedStatus
+	for address, peer := range t.peers {
+		if peer.Trusted {
+			continue
+		}
+		list = append(list, t.encryptedStatus(address))
+	}
+	return list
+}
+
+func (t *Tinzenite) encryptedStatus(address string) EncryptedStatus {
+	t.schedule.mutex.Lock()
+	status := t.schedule.state(address).status
+	t.schedule.mutex.Unlock()
+	status.Locked = t.hasLease(address)
+	return status
+}
+
+/*
+localChanged notes a local change that encrypted peers must receive. The time of
+the last change is kept, so that a sync only starts once a burst has settled.
+*/
+func (t *Tinzenite) localChanged() {
+	t.schedule.mutex.Lock()
+	defer t.schedule.mutex.Unlock()
+	t.schedule.changed = time.Now()
+}
+
+/*
+scheduleEncrypted is called periodically and starts the syncs that are due.
+*/
+func (t *Tinzenite) scheduleEncrypted() {
+	now := time.Now()
+	t.schedule.mutex.Lock()
+	policy := t.schedule.policy
+	changed := t.schedule.changed
+	t.schedule.mutex.Unlock()
+	settled := policy.Settle > 0 && !changed.IsZero() && now.Sub(changed) > policy.Settle
+	for address, peer := range t.peers {
+		if peer.Trusted {
+			continue
+		}
+		t.schedule.mutex.Lock()
+		last := t.schedule.state(address).status.LastSuccess
+		t.schedule.mutex.Unlock()
+		due := policy.Interval > 0 && now.Sub(last) > policy.Interval
+		if settled || due {
+			t.autoSyncEncrypted(address)
+		}
+	}
+	if settled {
+		t.schedule.mutex.Lock()
+		// only forget changes that happened before the syncs were started
+		if t.schedule.changed.Equal(changed) {
+			t.schedule.changed = time.Time{}
+		}
+		t.schedule.mutex.Unlock()
+	}
+}
+
+/*
+onEncryptedConnected starts a sync with an encrypted peer that came online.
+*/
+func (t *Tinzenite) onEncryptedConnected(address string) {
+	t.schedule.mutex.Lock()
+	onConnect := t.schedule.policy.OnConnect
+	t.schedule.mutex.Unlock()
+	if onConnect {
+		t.autoSyncEncrypted(address)
+	}
+}
+
+/*
+autoSyncEncrypted starts a sync with the encrypted peer at address unless it is
+backed off, offline, or busy with another sync, repair or audit.
+*/
+func (t *Tinzenite) autoSyncEncrypted(address string) {
+	// nothing to sync before the directory exists
+	if t.model == nil {
+		return
+	}
+	t.schedule.mutex.Lock()
+	backedOff := time.Now().Before(t.schedule.state(address).next)
+	t.schedule.mutex.Unlock()
+	// a sync of ours is already pending or running
+	if backedOff || t.hasLease(address) || t.repairJob(address) != nil {
+		return
+	}
+	online, _ := t.channel.IsAddressOnline(address)
+	if !online {
+		return
+	}
+	err := t.lockEncrypted(address)
+	if err != nil {
+		t.encryptedFailed(address, err.Error())
+	}
+}
+
+/*
+lockEncrypted starts a sync with the encrypted peer at address by requesting a
+lease. A sync that is already in progress is left alone unless it is stale.
+*/
+func (t *Tinzenite) lockEncrypted(address string) error {
+	peer, exists := t.peers[address]
+	if !exists {
+		return errPeerUnknown
+	}
+	if peer.IsLocked() {
+		if !t.isLeaseStale(address) {
+			return errEncryptedLocked
+		}
+		log.Println("Tinzenite: breaking stale lease on", address[:8])
+		t.releaseLease(address)
+	}
+	t.schedule.mutex.Lock()
+	t.schedule.state(address).status.LastAttempt = time.Now()
+	t.schedule.mutex.Unlock()
+	return t.requestLease(address)
+}
+
+/*
+encryptedSynced notes that a sync with the encrypted peer at address completed.
+*/
+func (t *Tinzenite) encryptedSynced(address string) {
+	t.schedule.mutex.Lock()
+	defer t.schedule.mutex.Unlock()
+	state := t.schedule.state(address)
+	state.status.LastSuccess = time.Now()
+	state.status.LastError = ""
+	state.status.Backoff = 0
+	state.next = time.Time{}
+}
+
+/*
+encryptedFailed notes that a sync with the encrypted peer at address failed and
+backs off further automatic syncs, doubling the wait on every failure.
+*/
+func (t *Tinzenite) encryptedFailed(address, reason string) {
+	t.schedule.mutex.Lock()
+	defer t.schedule.mutex.Unlock()
+	state := t.schedule.state(address)
+	backoff := 2 * state.status.Backoff
+	if backoff < leaseRenewal {
+		backoff = leaseRenewal
+	}
+	if backoff > maxEncryptedBackoff {
+		backoff = maxEncryptedBackoff
+	}
+	state.status.LastError = reason
+	state.status.Backoff = backoff
+	state.next = time.Now().Add(backoff)
+}
+
+/*
+state returns the state of the peer at address, creating it if required.
+NOTE: the caller must hold the mutex.
+*/
+func (s *schedule) state(address string) *scheduleState {
+	state, exists := s.peers[address]
+	if !exists {
+		state = &scheduleState{status: EncryptedStatus{Address: address}}
+		s.peers[address] = state
+	}
+	return state
+}
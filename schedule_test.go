@@ -0,0 +1,46 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_EncryptedBackoff(t *testing.T) {
+	tin := &Tinzenite{schedule: createSchedule()}
+	tin.encryptedFailed("encrypted", "busy")
+	tin.encryptedFailed("encrypted", "busy")
+	state := tin.schedule.peers["encrypted"]
+	if state.status.Backoff != 2*leaseRenewal {
+		t.Error("Expected backoff to double, got", state.status.Backoff)
+	}
+	if !state.next.After(time.Now()) || state.status.LastError != "busy" {
+		t.Error("Expected peer to be backed off with the reason, got", state.status)
+	}
+	for i := 0; i < 20; i++ {
+		tin.encryptedFailed("encrypted", "busy")
+	}
+	if state.status.Backoff != maxEncryptedBackoff {
+		t.Error("Expected backoff to be capped, got", state.status.Backoff)
+	}
+	tin.encryptedSynced("encrypted")
+	if state.status.Backoff != 0 || state.status.LastError != "" || !state.next.IsZero() {
+		t.Error("Expected success to reset the backoff, got", state.status)
+	}
+	if state.status.LastSuccess.IsZero() {
+		t.Error("Expected success to be recorded")
+	}
+}
+
+func Test_EncryptedLocalChanged(t *testing.T) {
+	tin := &Tinzenite{schedule: createSchedule()}
+	tin.localChanged()
+	first := tin.schedule.changed
+	if first.IsZero() {
+		t.Fatal("Expected change to be noted")
+	}
+	time.Sleep(time.Millisecond)
+	tin.localChanged()
+	if !tin.schedule.changed.After(first) {
+		t.Error("Expected the last unsynced change to be kept")
+	}
+}
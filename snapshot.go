@@ -0,0 +1,309 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Snapshot describes a point-in-time copy of the complete Tinzenite directory.
+*/
+type Snapshot struct {
+	ID    string    // identification of the snapshot
+	Label string    // label given by the user
+	Time  time.Time // time the snapshot was created
+	Files int       // number of files contained
+}
+
+/*
+snapshotManifest is what is stored for every snapshot: the snapshot info and the
+object tree of the model at that time. The content of the files is stored
+separately, deduplicated by content.
+*/
+type snapshotManifest struct {
+	Snapshot
+	Root *shared.ObjectInfo
+}
+
+/*
+CreateSnapshot stores the current state of the Tinzenite directory. Returns the
+identification of the created snapshot. NOTE: the .tinzenite directory is not
+part of snapshots.
+*/
+func (t *Tinzenite) CreateSnapshot(label string) (string, error) {
+	// make sure we capture the current state
+	err := t.model.Update()
+	if err != nil {
+		return "", err
+	}
+	root, err := t.model.Read()
+	if err != nil {
+		return "", err
+	}
+	id, err := shared.NewIdentifier()
+	if err != nil {
+		return "", err
+	}
+	manifest := &snapshotManifest{
+		Snapshot: Snapshot{
+			ID:    id,
+			Label: label,
+			Time:  time.Now()},
+		Root: root}
+	objectDir := t.snapshotPath() + "/" + SNAPSHOTOBJECTS
+	err = os.MkdirAll(objectDir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return "", err
+	}
+	// store content of every file that isn't already stored
+	root.ForEach(func(obj shared.ObjectInfo) {
+		if err != nil || obj.Directory || isTinzenitePath(obj.Path) {
+			return
+		}
+		manifest.Files++
+		blob := objectDir + "/" + contentName(obj.Content)
+		if _, statErr := os.Lstat(blob); statErr == nil {
+			return
+		}
+		err = copyFile(t.Path+"/"+obj.Path, blob)
+	})
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(t.snapshotPath()+"/"+id+shared.ENDING, data, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return "", err
+	}
+	log.Println("Tinzenite: created snapshot", label, "with", manifest.Files, "files.")
+	return id, nil
+}
+
+/*
+ListSnapshots returns all stored snapshots, oldest first.
+*/
+func (t *Tinzenite) ListSnapshots() ([]Snapshot, error) {
+	stats, err := ioutil.ReadDir(t.snapshotPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []Snapshot
+	for _, stat := range stats {
+		if stat.IsDir() {
+			continue
+		}
+		manifest, err := t.loadSnapshot(strings.TrimSuffix(stat.Name(), shared.ENDING))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, manifest.Snapshot)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.Before(list[j].Time)
+	})
+	return list, nil
+}
+
+/*
+RestoreSnapshot brings the Tinzenite directory back to the state of the given
+snapshot. All differences are applied as local changes, so the resulting
+creates, modifies and removes are sent to all peers. Files that are modified or
+removed are kept in the history so that the restore itself can be undone.
+*/
+func (t *Tinzenite) RestoreSnapshot(id string) error {
+	manifest, err := t.loadSnapshot(id)
+	if err != nil {
+		return err
+	}
+	// make sure the model knows of the current state
+	err = t.model.Update()
+	if err != nil {
+		return err
+	}
+	objectDir := t.snapshotPath() + "/" + SNAPSHOTOBJECTS
+	// build map of snapshot state and check that we can restore all of it
+	wanted := make(map[string]shared.ObjectInfo)
+	manifest.Root.ForEach(func(obj shared.ObjectInfo) {
+		if obj.Path == "" || isTinzenitePath(obj.Path) {
+			return
+		}
+		obj.Objects = nil
+		wanted[obj.Path] = obj
+		if obj.Directory {
+			return
+		}
+		if _, statErr := os.Lstat(objectDir + "/" + contentName(obj.Content)); statErr != nil {
+			err = errSnapshotIncomplete
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// remove everything not in the snapshot or of the wrong kind, deepest first
+	var current []string
+	for path := range t.model.StaticInfos {
+		if !isTinzenitePath(path) {
+			current = append(current, path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(current)))
+	for _, path := range current {
+		stin := t.model.StaticInfos[path]
+		obj, exists := wanted[path]
+		if exists && obj.Directory == stin.Directory {
+			continue
+		}
+		if !stin.Directory {
+			t.keepSnapshotVersion(path, stin.Content, shared.OpRemove)
+		}
+		err := os.RemoveAll(t.Path + "/" + path)
+		if err != nil {
+			return err
+		}
+	}
+	// create directories first: sorted order guarantees parents come before children
+	var paths []string
+	for path := range wanted {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		obj := wanted[path]
+		if !obj.Directory {
+			continue
+		}
+		err := os.MkdirAll(t.Path+"/"+path, shared.FILEPERMISSIONMODE)
+		if err != nil {
+			return err
+		}
+	}
+	// then write all files that differ
+	for _, path := range paths {
+		obj := wanted[path]
+		if obj.Directory {
+			continue
+		}
+		stin, exists := t.model.StaticInfos[path]
+		if exists && !stin.Directory {
+			if stin.Content == obj.Content {
+				continue
+			}
+			t.keepSnapshotVersion(path, stin.Content, shared.OpModify)
+		}
+		err := copyFile(objectDir+"/"+contentName(obj.Content), t.Path+"/"+path)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Tinzenite: restored snapshot", manifest.Label, ".")
+	// model picks up all changes as local ones and sends them to the peers
+	return t.model.Update()
+}
+
+/*
+RemoveSnapshot removes the given snapshot and all content no other snapshot
+references.
+*/
+func (t *Tinzenite) RemoveSnapshot(id string) error {
+	if _, err := t.loadSnapshot(id); err != nil {
+		return err
+	}
+	err := os.Remove(t.snapshotPath() + "/" + id + shared.ENDING)
+	if err != nil {
+		return err
+	}
+	// gather content still in use
+	snapshots, err := t.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		manifest, err := t.loadSnapshot(snapshot.ID)
+		if err != nil {
+			return err
+		}
+		manifest.Root.ForEach(func(obj shared.ObjectInfo) {
+			if !obj.Directory {
+				used[contentName(obj.Content)] = true
+			}
+		})
+	}
+	objectDir := t.snapshotPath() + "/" + SNAPSHOTOBJECTS
+	blobs, err := ioutil.ReadDir(objectDir)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if used[blob.Name()] {
+			continue
+		}
+		err := os.Remove(objectDir + "/" + blob.Name())
+		if err != nil {
+			log.Println("Tinzenite: failed to remove unused snapshot content:", err)
+		}
+	}
+	return nil
+}
+
+func (t *Tinzenite) loadSnapshot(id string) (*snapshotManifest, error) {
+	data, err := ioutil.ReadFile(t.snapshotPath() + "/" + id + shared.ENDING)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errSnapshotUnknown
+		}
+		return nil, err
+	}
+	manifest := &snapshotManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+/*
+keepSnapshotVersion keeps the current content of path in the history before a
+restore replaces it. Failing is only warned about as the restore must go on.
+*/
+func (t *Tinzenite) keepSnapshotVersion(path, content string, op shared.Operation) {
+	err := t.history.store(path, t.Path+"/"+path, content, op)
+	if err != nil {
+		log.Println("Tinzenite: failed to keep version of", path, ":", err)
+	}
+}
+
+func (t *Tinzenite) snapshotPath() string {
+	return t.Path + "/" + shared.STOREMODELDIR + "/" + SNAPSHOTDIR
+}
+
+/*
+contentName returns the name under which content is stored, deduplicated.
+*/
+func contentName(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+isTinzenitePath returns true if the sub path lies within the .tinzenite
+directory.
+*/
+func isTinzenitePath(path string) bool {
+	return path == shared.TINZENITEDIR || strings.HasPrefix(path, shared.TINZENITEDIR+"/")
+}
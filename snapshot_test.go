@@ -0,0 +1,43 @@
+package core
+
+import "testing"
+
+func Test_RestoreSnapshot(t *testing.T) {
+	network := createTestNetwork(t, 2)
+	defer network.close()
+	one := network.peers[0]
+	network.mkdir(one, "dir")
+	network.write(one, "dir/kept", "kept")
+	network.write(one, "changed", "before")
+	network.write(one, "removed", "removed")
+	network.settle()
+	id, err := one.tin.CreateSnapshot("before bulk change")
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	// bad bulk change
+	network.write(one, "changed", "after")
+	network.remove(one, "removed")
+	network.write(one, "dir/added", "added")
+	network.settle()
+	err = one.tin.RestoreSnapshot(id)
+	if err != nil {
+		t.Fatal("Expected no error:", err)
+	}
+	network.settle()
+	for _, peer := range network.peers {
+		network.expectContent(peer, "dir/kept", "kept")
+		network.expectContent(peer, "changed", "before")
+		network.expectContent(peer, "removed", "removed")
+		network.expectMissing(peer, "dir/added")
+	}
+	// the replaced version must be in the history
+	versions, err := one.tin.History("changed")
+	if err != nil || len(versions) == 0 {
+		t.Error("Expected history of restored file, got", versions, err)
+	}
+	list, err := one.tin.ListSnapshots()
+	if err != nil || len(list) != 1 || list[0].ID != id {
+		t.Error("Expected snapshot to be listed, got", list, err)
+	}
+}
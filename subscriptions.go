@@ -0,0 +1,368 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Subscription declares which paths a peer wants to receive the content of. Paths
+are sub paths within the directory. Exclude wins over Include; an empty Include
+means everything. The Tinzenite directory itself is always included.
+*/
+type Subscription struct {
+	Include []string // paths to receive, all if empty
+	Exclude []string // paths never to receive
+}
+
+/*
+subscriptions caches the subscriptions of all peers, stored as one file per peer
+in the org directory, together with the objects this peer tracks without their
+content because it has not subscribed to them.
+*/
+type subscriptions struct {
+	mutex    sync.Mutex
+	path     string                       // local file of the excluded objects
+	peers    map[string]Subscription      // by peer identification
+	Excluded map[string]shared.ObjectInfo // known but not subscribed objects by sub path
+}
+
+func loadSubscriptions(path string) (*subscriptions, error) {
+	s := &subscriptions{
+		path:     path,
+		peers:    make(map[string]Subscription),
+		Excluded: make(map[string]shared.ObjectInfo)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Excluded == nil {
+		s.Excluded = make(map[string]shared.ObjectInfo)
+	}
+	return s, nil
+}
+
+/*
+SetSubscription sets the paths this peer wants to receive. The subscription is
+distributed to all peers. Objects that become subscribed are fetched on the next
+SyncRemote. NOTE: content that is already present locally is kept.
+*/
+func (t *Tinzenite) SetSubscription(sub Subscription) error {
+	sub.Include = cleanPaths(sub.Include)
+	sub.Exclude = cleanPaths(sub.Exclude)
+	dir := t.subscriptionPath()
+	path := dir + "/" + t.selfpeer.Identification + shared.ENDING
+	if len(sub.Include) == 0 && len(sub.Exclude) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		data, err := json.MarshalIndent(sub, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
+		if err != nil {
+			return err
+		}
+	}
+	t.subscriptions.mutex.Lock()
+	t.subscriptions.peers[t.selfpeer.Identification] = sub
+	// forget what is now subscribed so that it is fetched like any new object
+	for subPath := range t.subscriptions.Excluded {
+		if sub.matches(subPath) {
+			delete(t.subscriptions.Excluded, subPath)
+		}
+	}
+	err := t.subscriptions.store()
+	t.subscriptions.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.model.PartialUpdate(dir)
+}
+
+/*
+isOwnSubscription returns true if the update is of the subscription file of the
+peer at address, or creates the directory holding it. Those are the only org
+changes peers may make without being admins.
+*/
+func (t *Tinzenite) isOwnSubscription(address string, msg *shared.UpdateMessage) bool {
+	dir := shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + SUBSCRIPTIONSDIR
+	if msg.Object.Path == dir {
+		return msg.Operation == shared.OpCreate
+	}
+	peer, exists := t.peers[address]
+	return exists && msg.Object.Path == dir+"/"+peer.Identification+shared.ENDING
+}
+
+/*
+PeerSubscription returns the subscription of the peer at address.
+*/
+func (t *Tinzenite) PeerSubscription(address string) (Subscription, error) {
+	peer, exists := t.peers[address]
+	if !exists {
+		return Subscription{}, errPeerUnknown
+	}
+	t.subscriptions.mutex.Lock()
+	defer t.subscriptions.mutex.Unlock()
+	return t.subscriptions.peers[peer.Identification], nil
+}
+
+/*
+ExcludedObjects returns the objects that exist in the network but whose content
+this peer doesn't receive, sorted by path.
+*/
+func (t *Tinzenite) ExcludedObjects() []shared.ObjectInfo {
+	t.subscriptions.mutex.Lock()
+	defer t.subscriptions.mutex.Unlock()
+	var paths []string
+	for subPath := range t.subscriptions.Excluded {
+		paths = append(paths, subPath)
+	}
+	sort.Strings(paths)
+	var list []shared.ObjectInfo
+	for _, subPath := range paths {
+		list = append(list, t.subscriptions.Excluded[subPath])
+	}
+	return list
+}
+
+/*
+loadPeerSubscriptions rereads the subscriptions of all peers from disk.
+*/
+func (t *Tinzenite) loadPeerSubscriptions() error {
+	peers := make(map[string]Subscription)
+	stats, err := ioutil.ReadDir(t.subscriptionPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, stat := range stats {
+		if stat.IsDir() || !strings.HasSuffix(stat.Name(), shared.ENDING) {
+			continue
+		}
+		data, err := ioutil.ReadFile(t.subscriptionPath() + "/" + stat.Name())
+		if err != nil {
+			return err
+		}
+		sub := Subscription{}
+		err = json.Unmarshal(data, &sub)
+		if err != nil {
+			log.Println("Tinzenite: ignoring invalid subscription", stat.Name(), ":", err)
+			continue
+		}
+		peers[strings.TrimSuffix(stat.Name(), shared.ENDING)] = sub
+	}
+	t.subscriptions.mutex.Lock()
+	t.subscriptions.peers = peers
+	t.subscriptions.mutex.Unlock()
+	return nil
+}
+
+/*
+isSubscribed returns true if the peer at address receives the content of the
+sub path. Unknown peers receive everything.
+*/
+func (t *Tinzenite) isSubscribed(address, subPath string) bool {
+	peer, exists := t.peers[address]
+	if !exists {
+		return true
+	}
+	t.subscriptions.mutex.Lock()
+	sub := t.subscriptions.peers[peer.Identification]
+	t.subscriptions.mutex.Unlock()
+	return sub.matches(subPath)
+}
+
+/*
+forSubscriber prepares an update for the peer at address: updates of paths the
+peer is not subscribed to are sent as shadows, so that the peer only tracks them.
+*/
+func (t *Tinzenite) forSubscriber(address string, msg shared.UpdateMessage) shared.UpdateMessage {
+	if t.isSubscribed(address, msg.Object.Path) {
+		return msg
+	}
+	msg.Object = *shadowCopy(&msg.Object)
+	return msg
+}
+
+/*
+filterModel returns a copy of the model for the peer at address without the
+objects it may not receive, in which all objects the peer is not subscribed to
+are shadows.
+*/
+func (t *Tinzenite) filterModel(address string, root *shared.ObjectInfo) *shared.ObjectInfo {
+	peer, exists := t.peers[address]
+	if !exists {
+		return root
+	}
+	t.subscriptions.mutex.Lock()
+	sub := t.subscriptions.peers[peer.Identification]
+	t.subscriptions.mutex.Unlock()
+	// objects the peer may not receive are not even shown
+	return filterObject(t.dropUnreadable(address, root), sub)
+}
+
+/*
+trackExcluded remembers an update of an object this peer is not subscribed to
+without fetching its content. Removals are acknowledged right away, as there is
+nothing to remove locally.
+*/
+func (t *Tinzenite) trackExcluded(address string, msg *shared.UpdateMessage) error {
+	t.subscriptions.mutex.Lock()
+	if msg.Operation == shared.OpRemove {
+		for subPath := range t.subscriptions.Excluded {
+			if isWithin(subPath, msg.Object.Path) {
+				delete(t.subscriptions.Excluded, subPath)
+			}
+		}
+	} else {
+		msg.Object.ForEach(func(obj shared.ObjectInfo) {
+			obj.Shadow = true
+			obj.Content = ""
+			obj.Objects = nil
+			t.subscriptions.Excluded[obj.Path] = obj
+		})
+		obj := *shadowCopy(&msg.Object)
+		obj.Objects = nil
+		t.subscriptions.Excluded[obj.Path] = obj
+	}
+	err := t.subscriptions.store()
+	t.subscriptions.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if msg.Operation == shared.OpRemove {
+		ot := t.cInterface.determineObjectTypeBy(msg.Object.Path)
+		nm := shared.CreateNotifyMessage(shared.NoRemoved, msg.Object.Name, ot)
+		t.channel.Send(address, nm.JSON())
+	}
+	return nil
+}
+
+/*
+wantsContent returns true if this peer should fetch the content of the update.
+Objects that are present locally are always kept up to date.
+*/
+func (t *Tinzenite) wantsContent(msg *shared.UpdateMessage) bool {
+	_, err := t.model.GetInfo(shared.CreatePath(t.model.RootPath, msg.Object.Path))
+	if err == nil {
+		msg.Object.Shadow = false
+		return true
+	}
+	if msg.Object.Shadow {
+		return false
+	}
+	t.subscriptions.mutex.Lock()
+	sub := t.subscriptions.peers[t.selfpeer.Identification]
+	t.subscriptions.mutex.Unlock()
+	return sub.matches(msg.Object.Path)
+}
+
+/*
+matches returns true if the subscription includes the sub path. Parents of
+included paths match too, so that the directories leading to them exist.
+*/
+func (s Subscription) matches(subPath string) bool {
+	if subPath == "" || isWithin(subPath, shared.TINZENITEDIR) {
+		return true
+	}
+	for _, excluded := range s.Exclude {
+		if isWithin(subPath, excluded) {
+			return false
+		}
+	}
+	if len(s.Include) == 0 {
+		return true
+	}
+	for _, included := range s.Include {
+		if isWithin(subPath, included) || isWithin(included, subPath) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+store writes the excluded objects to disk. NOTE: the caller must hold the mutex.
+*/
+func (s *subscriptions) store() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, shared.FILEPERMISSIONMODE)
+}
+
+func (t *Tinzenite) subscriptionPath() string {
+	return t.Path + "/" + shared.TINZENITEDIR + "/" + shared.ORGDIR + "/" + SUBSCRIPTIONSDIR
+}
+
+/*
+filterObject copies obj, turning everything that doesn't match into shadows.
+*/
+func filterObject(obj *shared.ObjectInfo, sub Subscription) *shared.ObjectInfo {
+	if !sub.matches(obj.Path) {
+		return shadowCopy(obj)
+	}
+	copied := *obj
+	copied.Objects = nil
+	for _, child := range obj.Objects {
+		copied.Objects = append(copied.Objects, filterObject(child, sub))
+	}
+	return &copied
+}
+
+/*
+shadowCopy copies obj and all its children as shadows without content.
+*/
+func shadowCopy(obj *shared.ObjectInfo) *shared.ObjectInfo {
+	copied := *obj
+	copied.Shadow = true
+	copied.Content = ""
+	copied.Objects = nil
+	for _, child := range obj.Objects {
+		copied.Objects = append(copied.Objects, shadowCopy(child))
+	}
+	return &copied
+}
+
+/*
+isWithin returns true if path is dir or lies within it.
+*/
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+/*
+cleanPaths removes surrounding slashes and empty entries.
+*/
+func cleanPaths(paths []string) []string {
+	var cleaned []string
+	for _, path := range paths {
+		path = strings.Trim(path, "/")
+		if path != "" {
+			cleaned = append(cleaned, path)
+		}
+	}
+	return cleaned
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func Test_SubscriptionMatches(t *testing.T) {
+	sub := Subscription{
+		Include: cleanPaths([]string{"/photos/2016/", "docs"}),
+		Exclude: []string{"docs/archive"}}
+	cases := map[string]bool{
+		"":                         true,
+		"photos":                   true, // parent of an include
+		"photos/2016/beach.jpg":    true,
+		"photos/2015/beach.jpg":    false,
+		"docs/letter.txt":          true,
+		"docs/archive/old.txt":     false,
+		"docsextra/file.txt":       false,
+		"music/song.mp3":           false,
+		shared.TINZENITEDIR + "/x": true}
+	for path, expected := range cases {
+		if sub.matches(path) != expected {
+			t.Error("Expected", path, "to match", expected)
+		}
+	}
+	if !(Subscription{}).matches("anything/at/all") {
+		t.Error("Expected empty subscription to match everything")
+	}
+}
+
+func Test_FilterModel(t *testing.T) {
+	root := &shared.ObjectInfo{Directory: true, Objects: []*shared.ObjectInfo{
+		{Path: "keep.txt", Content: "a"},
+		{Path: "big", Directory: true, Objects: []*shared.ObjectInfo{
+			{Path: "big/video.mp4", Content: "b"}}}}}
+	filtered := filterObject(root, Subscription{Exclude: []string{"big"}})
+	if filtered.Objects[0].Shadow || filtered.Objects[0].Content != "a" {
+		t.Error("Expected subscribed object to be unchanged")
+	}
+	big := filtered.Objects[1]
+	if !big.Shadow || len(big.Objects) != 1 || !big.Objects[0].Shadow || big.Objects[0].Content != "" {
+		t.Error("Expected excluded subtree to be shadows without content")
+	}
+	// the original must not be modified
+	if root.Objects[1].Shadow || root.Objects[1].Objects[0].Content != "b" {
+		t.Error("Expected original model to be unchanged")
+	}
+}
@@ -2,14 +2,11 @@ package core
 
 import (
 	"crypto/rand"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
 	"math/big"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
@@ -34,6 +31,31 @@ type Tinzenite struct {
 	stop           chan bool
 	wg             sync.WaitGroup
 	peerValidation PeerValidation
+	history        *history
+	guard          *guard
+	audit          *audit
+	revoked        map[string]bool // addresses and identifications of removed peers
+	pending        *pending
+	invites        *invites
+	roles          *roles
+	governance     *governance
+	capabilities   *capabilities
+	liveness       *liveness
+	subscriptions  *subscriptions
+	acl            *acl
+	leases         *leases
+	repairs        *repairs
+	manifest       *manifest
+	schedule       *schedule
+	replicas       *replicas
+	padding        *padding
+	outbox         *outbox
+	// massChangeValidation is the callback asking to confirm a mass change
+	massChangeValidation MassChangeValidation
+	// orgChangeValidation is the callback asking admins to approve an org change
+	orgChangeValidation OrgChangeValidation
+	// replicaWarning is the callback warning of objects below their replica target
+	replicaWarning ReplicaWarning
 }
 
 /*
@@ -59,6 +81,10 @@ func (t *Tinzenite) SyncRemote() error {
 			// this also skips if the peer is offline as offline peers are unauthenticated
 			continue
 		}
+		// read-only peers have nothing to contribute
+		if t.IsReadOnly(address) {
+			continue
+		}
 		// create & modify must first fetch file
 		rm := shared.CreateRequestMessage(shared.OtModel, shared.IDMODEL)
 		// request file and apply update on success
@@ -69,10 +95,10 @@ func (t *Tinzenite) SyncRemote() error {
 
 /*
 SyncEncrypted tries to lock available encrypted peers. If successful will update
-them to the current state while updating any outstanding issues.
-
-TODO FIXME maybe this should be included in sync remote. Although there is
-something to be said that it is the job of the client to handle this intelligently...
+them to the current state while updating any outstanding issues. Peers are
+locked in the order they were last synced, the most recent first, so that
+updates are pulled from the most current peer first. NOTE: encrypted peers are
+also synchronized automatically, see SetEncryptedPolicy.
 */
 func (t *Tinzenite) SyncEncrypted() error {
 	t.muteFlag = true
@@ -82,41 +108,23 @@ func (t *Tinzenite) SyncEncrypted() error {
 	if err != nil {
 		return err
 	}
-	// build lock message we'll use for all
-	lm := shared.CreateLockMessage(shared.LoRequest)
-	ulm := shared.CreateLockMessage(shared.LoRelease)
 	// try to lock all encrypted peers
-	for address, peer := range t.peers {
+	for _, address := range t.syncOrder() {
 		trusted, err := t.isPeerTrusted(address)
 		// if authenticated or wrongly unauthenticated, ignore
 		if trusted || err != nil {
 			continue
 		}
-		// if already locked transfer is in progress, so ignore
-		if peer.IsLocked() {
-			// if no transfers exists any more for this peer, unlock and release
-			var active bool
-			for key := range t.cInterface.outTransfers {
-				if strings.Contains(key, peer.Address) {
-					active = true
-					break
-				}
-			}
-			// if still active ignore
-			if active {
-				continue
-			}
-			// if NOT active any more, unlock and send release message
-			peer.SetLocked(false)
-			t.channel.Send(address, ulm.JSON())
-		}
 		// check if online
 		online, _ := t.channel.IsAddressOnline(address)
 		if !online {
 			continue
 		}
-		// try to lock
-		t.channel.Send(address, lm.JSON())
+		// try to lock, if already locked a sync is in progress
+		err = t.lockEncrypted(address)
+		if err != nil && err != errEncryptedLocked {
+			log.Println("Tinzenite: failed to request lock:", err)
+		}
 	}
 	return nil
 }
@@ -230,14 +238,19 @@ func (t *Tinzenite) PrintStatus() string {
 }
 
 /*
-DisconnectPeer does exactly that. NOTE: this is a passive action and doesn't do
-anything except remove the peer from the network. The peer is not further
+DisconnectPeer removes the peer from the network. The removal is written to the
+revocation list, which is synchronized to all other peers so that they remove
+the peer too and refuse it from then on. NOTE: the removed peer itself is not
 notified.
 
 TODO: maybe not use name but Identification?
-TODO: when will other peers remove it? They need to remove the contact info from the channel... FIXME
 */
 func (t *Tinzenite) DisconnectPeer(peerName string) {
+	// removing peers changes the org directory
+	if err := t.requireAdmin(); err != nil {
+		log.Println("DisconnectPeer:", err)
+		return
+	}
 	newPeers := make(map[string]*shared.Peer)
 	for _, peer := range t.peers {
 		if t.selfpeer.Identification == peer.Identification {
@@ -245,29 +258,25 @@ func (t *Tinzenite) DisconnectPeer(peerName string) {
 		}
 		if peer.Name == peerName {
 			log.Println("Removing", peer.Name, "at", peer.Address[:8])
-			// delete peer file
-			path := shared.CreatePath(t.Path, shared.TINZENITEDIR+"/"+shared.ORGDIR+"/"+shared.PEERSDIR+"/"+peer.Identification+shared.ENDING)
-			err := t.model.ApplyRemove(path, nil)
+			// revoke first so that the peer will not be readded from disk
+			err := t.revokePeer(peer)
 			if err != nil {
 				log.Println("DisconnectPeer:", err)
 			}
-			// remove from channel
-			err = t.channel.RemoveConnection(peer.Address)
+			// the peer is removed once the revocation is approved
+			if t.needsApproval() {
+				log.Println("Removal of", peer.Name, "awaits approval.")
+				newPeers[peer.Address] = peer
+				continue
+			}
+			// delete peer file
+			path := shared.CreatePath(t.Path, shared.TINZENITEDIR+"/"+shared.ORGDIR+"/"+shared.PEERSDIR+"/"+peer.Identification+shared.ENDING)
+			err = t.model.ApplyRemove(path, nil)
 			if err != nil {
 				log.Println("DisconnectPeer:", err)
 			}
-			// write peer to all removals so that no removals will be orphaned
-			removePath := t.Path + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR
-			allRemovals, _ := ioutil.ReadDir(removePath)
-			// for every object that is currently being removed
-			for _, stat := range allRemovals {
-				// write the to be removed peer as done
-				err := t.model.UpdateRemovalDir(stat.Name(), peer.Identification)
-				if err != nil {
-					// warn if it failed
-					log.Println("Tinzenite: failed to purge removed peer from removal!")
-				}
-			}
+			// remove from channel and removals
+			t.purgePeer(peer)
 			// continue does not readd to tinzenite, removing the reference to it
 			continue
 		}
@@ -278,29 +287,40 @@ func (t *Tinzenite) DisconnectPeer(peerName string) {
 
 /*
 AllowPeer should be called if a connection request is to be accepted after the
-user has verified it. NOTE: friend requests should be replied to ASAP, since
-they are NOT persistantly stored!
+user has verified it. Requests are stored until they are allowed, denied, or
+expire, see PendingPeers.
 */
 func (t *Tinzenite) AllowPeer(address string) error {
+	// adding peers changes the org directory
+	err := t.requireAdmin()
+	if err != nil {
+		return err
+	}
 	// do we know of a connection attempt for said address?
-	peer, exists := t.cInterface.connections[address]
-	if !exists {
-		return errors.New("unknown friend request")
+	peer, err := t.pending.take(address)
+	if err != nil {
+		return err
 	}
-	// if yes, add connection
+	return t.acceptPeer(address, peer)
+}
+
+/*
+acceptPeer adds the peer that sent a friend request from address to the network.
+*/
+func (t *Tinzenite) acceptPeer(address string, peer *shared.Peer) error {
+	// add connection
 	err := t.channel.AcceptConnection(address)
 	if err != nil {
 		// warn but don't return error: may be added later automatically
 		log.Println("Tinzenite: WARNING: failed to add address to channel:", err)
 	}
-	// remove memory
-	delete(t.cInterface.connections, address)
 	// ensure that address is correct by overwritting sent address with real one
 	peer.Address = address
 	// IF trusted peer (and accepting this peer verifies that choice), set to authorized immediately because bootstrap doesn't have auth
 	peer.SetAuthenticated(true)
 	// add peer to local list
 	t.peers[address] = peer
+	t.markAuthenticated(address)
 	// try store new peer to disk
 	return t.Store()
 }
@@ -358,10 +378,44 @@ func (t *Tinzenite) checkPeerAuth() error {
 	return nil
 }
 
+/*
+loadOrg rereads everything kept in the org directory. While an org change of
+this peer awaits approval nothing is reread, as the change is already on disk.
+*/
+func (t *Tinzenite) loadOrg() error {
+	if t.hasOwnProposals() {
+		return nil
+	}
+	// remove peers that have been removed by any peer
+	err := t.applyRevocations()
+	if err != nil {
+		return err
+	}
+	// roles and governance may have changed
+	err = t.loadRoles()
+	if err != nil {
+		return err
+	}
+	err = t.loadGovernance()
+	if err != nil {
+		return err
+	}
+	err = t.loadPeerSubscriptions()
+	if err != nil {
+		return err
+	}
+	return t.loadACL()
+}
+
 /*
 checkPeers checks whether the loaded peers are in sync with the peers on disk.
 */
 func (t *Tinzenite) checkPeers() error {
+	// the org directory may have changed
+	err := t.loadOrg()
+	if err != nil {
+		return err
+	}
 	// load peers from disk
 	loadedPeers, err := shared.LoadPeers(t.Path)
 	if err != nil {
@@ -374,12 +428,15 @@ func (t *Tinzenite) checkPeers() error {
 		if _, exists := t.peers[address]; exists {
 			continue
 		}
+		// never readd removed peers, even if their peer file still exists
+		if t.isRevoked(address) || t.revoked[peer.Identification] {
+			continue
+		}
 		// otherwise add peer to t.peers
 		t.peers[address] = peer
 		// notify that new peer has been added to this instance
 		log.Println("Tinzenite: new peer detected:", address[:8])
 	}
-	// TODO what about REMOVED peers? See DisconnectPeer method above ^^
 	return nil
 }
 
@@ -476,15 +533,93 @@ func (t *Tinzenite) merge(msg *shared.UpdateMessage) error {
 }
 
 /*
-initialize the background process.
+loadStores loads the local stores. Must be called before the channel is created
+as its callbacks use them. NOTE: the model may not exist yet.
+*/
+func (t *Tinzenite) loadStores() error {
+	pending, err := loadPending(t.Path + "/" + shared.STOREMODELDIR + "/" + PENDINGFILE)
+	if err != nil {
+		return err
+	}
+	t.pending = pending
+	invites, err := loadInvites(t.Path + "/" + shared.STOREMODELDIR + "/" + INVITEFILE)
+	if err != nil {
+		return err
+	}
+	t.invites = invites
+	liveness, err := loadLiveness(t.Path + "/" + shared.STOREMODELDIR + "/" + PEERINFOFILE)
+	if err != nil {
+		return err
+	}
+	t.liveness = liveness
+	subscriptions, err := loadSubscriptions(t.Path + "/" + shared.STOREMODELDIR + "/" + EXCLUDEDFILE)
+	if err != nil {
+		return err
+	}
+	t.subscriptions = subscriptions
+	leases, err := loadLeases(t.Path + "/" + shared.STOREMODELDIR + "/" + LEASEFILE)
+	if err != nil {
+		return err
+	}
+	t.leases = leases
+	t.repairs = createRepairs()
+	manifest, err := loadManifest(t.Path + "/" + shared.STOREMODELDIR + "/" + MANIFESTFILE)
+	if err != nil {
+		return err
+	}
+	t.manifest = manifest
+	t.schedule = createSchedule()
+	t.replicas = createReplicas()
+	t.padding = createPadding()
+	outbox, err := loadOutbox(t.Path + "/" + shared.STOREMODELDIR + "/" + OUTBOXFILE)
+	if err != nil {
+		return err
+	}
+	t.outbox = outbox
+	t.revoked = make(map[string]bool)
+	t.capabilities = createCapabilities()
+	return nil
+}
+
+/*
+initialize the org dependent stores and the background process. NOTE: the local
+stores must have been loaded with loadStores before.
 */
-func (t *Tinzenite) initialize() {
+func (t *Tinzenite) initialize() error {
+	err := t.loadPeerSubscriptions()
+	if err != nil {
+		log.Println("Tinzenite: failed to load subscriptions:", err)
+	}
+	t.acl = &acl{}
+	err = t.loadACL()
+	if err != nil {
+		log.Println("Tinzenite: failed to load ACL:", err)
+	}
 	// prepare send channel that will distribute updates
 	t.wg.Add(1)
 	t.stop = make(chan bool, 1)
 	t.sendChannel = make(chan shared.UpdateMessage, 1)
+	t.history = createHistory(t.Path + "/" + shared.STOREMODELDIR + "/" + HISTORYDIR)
+	t.guard = createGuard()
+	t.audit = createAudit(t.Path + "/" + shared.STOREMODELDIR + "/" + AUDITLOG)
+	t.roles = createRoles()
+	err = t.loadRoles()
+	if err != nil {
+		log.Println("Tinzenite: failed to load roles:", err)
+	}
+	t.governance = createGovernance()
+	err = t.loadGovernance()
+	if err != nil {
+		log.Println("Tinzenite: failed to load governance:", err)
+	}
+	// make sure removed peers are dropped before anything else happens
+	err = t.applyRevocations()
+	if err != nil {
+		log.Println("Tinzenite: failed to apply revocations:", err)
+	}
 	go t.background()
 	t.model.Register(t.sendChannel)
+	return nil
 }
 
 /*
@@ -496,6 +631,16 @@ func (t *Tinzenite) background() {
 	transferTicker := time.Tick(5 * time.Second)
 	// timer for peer management
 	peerTicker := time.Tick(10 * time.Second)
+	// timer for enforcing the history retention policy
+	historyTicker := time.Tick(10 * time.Minute)
+	// timer for measuring the latency to peers
+	pingTicker := time.Tick(1 * time.Minute)
+	// timer for renewing leases on encrypted peers
+	leaseTicker := time.Tick(leaseRenewal)
+	// timer for auditing encrypted peers
+	auditTicker := time.Tick(auditInterval)
+	// timer for scheduling syncs with encrypted peers
+	encryptedTicker := time.Tick(10 * time.Second)
 	for {
 		select {
 		case <-t.stop:
@@ -513,6 +658,24 @@ func (t *Tinzenite) background() {
 			if err != nil {
 				log.Println("Tin: error checking authority of peers:", err)
 			}
+			// notice peers that went offline
+			t.checkLiveness()
+			// approvals for changes that never arrived
+			t.expireProposals()
+		case <-pingTicker:
+			t.sendPings()
+		case <-leaseTicker:
+			t.renewLeases()
+		case <-auditTicker:
+			// downloads from encrypted peers take a while
+			go t.auditAll()
+		case <-encryptedTicker:
+			t.scheduleEncrypted()
+		case <-historyTicker:
+			err := t.history.prune()
+			if err != nil {
+				log.Println("Tin: error pruning history:", err)
+			}
 		case <-transferTicker:
 			currentTransfers := t.channel.ActiveTransfers()
 			// if currently none, done
@@ -529,25 +692,70 @@ func (t *Tinzenite) background() {
 			}
 			log.Printf("Tin: Pending %d transfers, current one at %d%%.\n", len(currentTransfers), currentProgress)
 		case msg := <-t.sendChannel:
+			// record local change, even if it isn't sent right away
+			t.auditLocal(msg)
 			// if muted don't send updates
 			if t.muteFlag {
 				continue
 			}
-			// we only have to do this once for all logs
-			name := msg.Object.Name
-			// for better visibility add special mark to signify directory
-			if msg.Object.Directory {
-				name += "/++"
+			// encrypted peers receive it once changes settle
+			t.localChanged()
+			// read-only peers never publish their changes
+			if t.IsReadOnly(t.selfpeer.Address) {
+				t.suppressLocal(msg)
+				continue
 			}
-			// send to all trusted peers
-			for address := range t.peers {
-				trusted, _ := t.isPeerTrusted(address)
-				if !trusted {
-					continue
-				}
-				log.Printf("Tin: sending <%s> of <.../%s> to %s.\n", msg.Operation, name, address[:8])
-				t.channel.Send(address, msg.JSON())
-			} // for
+			// others would reject org changes of non admins anyway
+			if isOrgPath(msg.Object.Path) && t.requireAdmin() != nil {
+				log.Println("Tin: not an admin, keeping change of", msg.Object.Path, "local.")
+				continue
+			}
+			// same for paths the ACL doesn't allow us to change
+			if !t.canWrite(t.selfpeer.Address, msg.Object.Path) {
+				log.Println("Tin: no write access, keeping change of", msg.Object.Path, "local.")
+				continue
+			}
+			// hold back suspicious mass changes
+			if t.holdOutgoing(msg) {
+				continue
+			}
+			// org changes wait for approval here too
+			t.proposeOwn(msg)
+			t.broadcast(msg)
 		} // select
 	} // for
 }
+
+/*
+broadcast sends the update message to all trusted peers.
+*/
+func (t *Tinzenite) broadcast(msg shared.UpdateMessage) {
+	// we only have to do this once for all logs
+	name := msg.Object.Name
+	// for better visibility add special mark to signify directory
+	if msg.Object.Directory {
+		name += "/++"
+	}
+	// send to all trusted peers
+	for address, peer := range t.peers {
+		trusted, _ := t.isPeerTrusted(address)
+		if !trusted {
+			// offline trusted peers receive it through an encrypted peer
+			if peer.Trusted && address != t.selfpeer.Address && t.canRead(address, msg.Object.Path) {
+				if online, _ := t.channel.IsAddressOnline(address); !online {
+					t.queueMail(address, t.forSubscriber(address, msg))
+				}
+			}
+			continue
+		}
+		log.Printf("Tin: sending <%s> of <.../%s> to %s.\n", msg.Operation, name, address[:8])
+		// never send what the peer may not receive
+		if !t.canRead(address, msg.Object.Path) {
+			t.withheld(address, msg)
+			continue
+		}
+		// only send shadows of paths the peer isn't subscribed to
+		peerMsg := t.forSubscriber(address, msg)
+		t.channel.Send(address, peerMsg.JSON())
+	}
+}
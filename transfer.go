@@ -11,6 +11,15 @@ type transfer struct {
 	done    onDone    // function to execute once the file has been received
 }
 
+/*
+transferKey identifies an in transfer by the address it is fetched from and the
+identification of the object, so that encrypted peers can serve the same
+identification at the same time. It is also the name of the received file.
+*/
+func transferKey(address, identification string) string {
+	return address + "." + identification
+}
+
 /*
 onDone is called when the transfer is successfully completed.
 */
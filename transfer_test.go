@@ -0,0 +1,44 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TransferKey(t *testing.T) {
+	tin := &Tinzenite{}
+	c := createChannelInterface(tin)
+	// encrypted peers serve the same identifications at the same time
+	c.inTransfers[transferKey("encryptedone", journalHead)] = transfer{updated: time.Now(), active: "encryptedone"}
+	c.inTransfers[transferKey("encryptedtwo", journalHead)] = transfer{updated: time.Now(), active: "encryptedtwo"}
+	if len(c.inTransfers) != 2 {
+		t.Error("Expected one transfer per peer, got", c.inTransfers)
+	}
+	if address, exists := c.fetchingFrom(journalHead); !exists || (address != "encryptedone" && address != "encryptedtwo") {
+		t.Error("Expected transfer to be found, got", address, exists)
+	}
+	// identifications containing the separator must not match others
+	if _, exists := c.fetchingFrom("head"); exists {
+		t.Error("Expected no transfer for a different identification")
+	}
+}
+
+func Test_TransferConcurrency(t *testing.T) {
+	tin := &Tinzenite{}
+	c := createChannelInterface(tin)
+	done := make(chan bool)
+	// repairs and syncs drop transfers from their own go routines
+	go func() {
+		for i := 0; i < 1000; i++ {
+			c.dropTransfer(transferKey("encrypted", "object"))
+		}
+		done <- true
+	}()
+	for i := 0; i < 1000; i++ {
+		c.mutex.Lock()
+		c.inTransfers[transferKey("encrypted", "object")] = transfer{updated: time.Now(), active: "encrypted"}
+		c.mutex.Unlock()
+		c.OnAllowFile("encrypted", "object")
+	}
+	<-done
+}